@@ -9,6 +9,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"sort"
 	"strings"
@@ -32,16 +33,24 @@ func printUsage() {
 func main() {
 	var (
 		peerHost, peerIP string
+		labels           string
 		dumpJson         bool
 		dumpDeleted      bool
+		oneWay           bool
+		bandwidth        bool
+		floor            bool
 	)
 
 	flag.BoolVar(&dumpJson, "J", false, "dump output as the raw JSON object")
 
 	flag.BoolVar(&dumpDeleted, "d", false, "included deleted peers in text output (JSON has DelPeers)")
+	flag.BoolVar(&oneWay, "w", false, "also report one-way (forward and return) delay estimates")
+	flag.BoolVar(&bandwidth, "b", false, "also report bandwidth probe results")
+	flag.BoolVar(&floor, "g", false, "also report distance and the light-in-fiber RTT floor of each path")
 
 	flag.StringVar(&peerHost, "H", "", "Hostname of a pingmesh peer (with optional :port suffix)")
 	flag.StringVar(&peerIP, "I", "", "IP of a pingmesh peer (overrides DNS Hostname if set)")
+	flag.StringVar(&labels, "l", "", "only report peers with these labels: comma-separated key:value or key")
 
 	flag.Usage = printUsage
 	flag.Parse()
@@ -51,6 +60,9 @@ func main() {
 		return
 	}
 	peerUrl := peerHost + "/v1/peers"
+	if len(labels) > 0 {
+		peerUrl += "?label=" + url.QueryEscape(labels)
+	}
 
 	rm, err := server.FetchRemotePeer(peerUrl, peerIP)
 	if err != nil {
@@ -94,6 +106,9 @@ func main() {
 				msecRTT = pt.Msec(p.PingTotals.TcpHs) / float64(p.Pings)
 				respTime = pt.Msec(p.PingTotals.Total) / float64(p.Pings)
 			}
+			if len(p.PeerIP) == 0 {
+				p.PeerIP = p.Remote
+			}
 			if len(p.PeerIP) == 0 {
 				p.PeerIP = " unknown "
 			}
@@ -101,6 +116,43 @@ func main() {
 				trimLoc(p.Location), p.Pings, p.Fails, start, server.Hhmmss(duration), msecRTT, respTime, p.PeerIP)
 		}
 
+		if oneWay {
+			fmt.Printf("\nOne-way delay estimates (msec, forward is from %s):\n", rm.SrvLoc)
+			fmt.Printf("%20s\t%s\t%s\t%s\t%s\t%s\n",
+				"Location", "Samples", "minRTT", "offset", "fwdAvg", "retAvg")
+			for _, p := range rm.Peers {
+				if ow := p.OneWay; ow != nil {
+					fmt.Printf("%20s\t%d\t%.03f\t%.03f\t%.03f\t%.03f\n",
+						trimLoc(p.Location), ow.Samples, pt.Msec(ow.MinRtt), pt.Msec(ow.Offset), pt.Msec(ow.FwdAvg), pt.Msec(ow.RetAvg))
+				}
+			}
+		}
+
+		if bandwidth {
+			fmt.Printf("\nBandwidth probes (Mbit/s, down is to %s):\n", rm.SrvLoc)
+			fmt.Printf("%20s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				"Location", "Probes", "Fails", "down", "up", "downAvg", "upAvg")
+			for _, p := range rm.Peers {
+				if bw := p.Bw; bw != nil {
+					fmt.Printf("%20s\t%d\t%d\t%.02f\t%.02f\t%.02f\t%.02f\n",
+						trimLoc(p.Location), bw.Probes, bw.Fails, bw.DownMbps, bw.UpMbps, bw.DownAvg, bw.UpAvg)
+				}
+			}
+		}
+
+		if floor {
+			fmt.Printf("\nDistance and RTT floor (msec, light in fiber) from %s:\n", rm.SrvLoc)
+			fmt.Printf("%20s\t%s\t%s\t%s\t%s\t%s\n",
+				"Location", "km", "floor", "msecRTT", "above", "ratio")
+			for _, p := range rm.Peers {
+				if p.FloorMs > 0 && p.Pings > 0 {
+					msecRTT := p.FloorMs + p.AboveFloor
+					fmt.Printf("%20s\t%.0f\t%.03f\t%.03f\t%.03f\t%.02f\n",
+						trimLoc(p.Location), p.DistanceKm, p.FloorMs, msecRTT, p.AboveFloor, msecRTT/p.FloorMs)
+				}
+			}
+		}
+
 		if dumpDeleted && len(rm.DelPeers) > 0 {
 			fmt.Printf("%s %s%s has %d deleted peers:\n",
 				rm.SrvLoc, peerHost, override, len(rm.DelPeers))
@@ -118,6 +170,9 @@ func main() {
 					msecRTT = pt.Msec(p.PingTotals.TcpHs) / float64(p.Pings)
 					respTime = pt.Msec(p.PingTotals.Total) / float64(p.Pings)
 				}
+				if len(p.PeerIP) == 0 {
+					p.PeerIP = p.Remote
+				}
 				if len(p.PeerIP) == 0 {
 					p.PeerIP = " unknown "
 				}
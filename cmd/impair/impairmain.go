@@ -0,0 +1,89 @@
+// impair is a proxy that injects network impairments in front of a local
+// pingmesh server (or any other TCP or HTTP server) for lab testing.
+package main
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client" // ParseURL
+	"github.com/rafayopen/pingmesh/pkg/impair"
+
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"time"
+)
+
+const usage = `Usage: %s [flags] target
+target: the host:port (or URL, in HTTP mode) to forward connections to.
+Accepts connections on the listen address and forwards them to target,
+adding latency and jitter in each direction, capping bandwidth, and
+dropping a fraction of connections.  With -http (implied by -e) it runs
+as an HTTP reverse proxy that also answers a fraction of requests with
+an error status.  The same -seed gives the same impairment sequence.
+
+Example, a 40ms +/- 5ms RTT path with 1%% loss in front of a pingmesh:
+  %s -l :8081 -latency 20ms -jitter 2.5ms -loss 0.01 localhost:8080
+
+Command line flags:
+`
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, usage, os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
+
+////
+// main reads command line arguments then runs the proxy until killed
+func main() {
+	var (
+		listenAddr string
+		httpMode   bool
+		kbps       int64
+		cfg        impair.Config
+	)
+
+	flag.StringVar(&listenAddr, "l", ":8081", "listen address")
+	flag.BoolVar(&httpMode, "http", false, "run as an HTTP reverse proxy (required for -e)")
+	flag.DurationVar(&cfg.Latency, "latency", 0, "one-way delay added in each direction")
+	flag.DurationVar(&cfg.Jitter, "jitter", 0, "random +/- variation of the one-way delay")
+	flag.Float64Var(&cfg.Loss, "loss", 0, "fraction (0 to 1) of connections to drop")
+	flag.Int64Var(&kbps, "bw", 0, "bandwidth cap per connection in kbit/s (default 0 is unlimited)")
+	flag.Float64Var(&cfg.ErrorRate, "e", 0, "fraction (0 to 1) of HTTP requests to fail")
+	flag.IntVar(&cfg.ErrorCode, "code", http.StatusServiceUnavailable, "HTTP status for failed requests")
+	flag.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "random seed (default is the time)")
+
+	flag.Usage = printUsage
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		printUsage()
+		os.Exit(1)
+	}
+	target := flag.Arg(0)
+	cfg.Bandwidth = kbps * 1000 / 8
+	if cfg.ErrorRate > 0 {
+		httpMode = true
+	}
+
+	l, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	im := impair.New(cfg)
+	log.Printf("impairing %s -> %s with %+v\n", listenAddr, target, im.Config())
+
+	if httpMode {
+		u := client.ParseURL(target)
+		if u == nil {
+			os.Exit(1) // ParseURL reported to log(stderr) already
+		}
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		err = http.Serve(impair.NewListener(l, im), impair.Handler(proxy, im))
+	} else {
+		err = impair.ServeTCP(impair.NewListener(l, im), target)
+	}
+	log.Fatal(err)
+}
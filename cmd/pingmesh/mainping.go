@@ -53,28 +53,56 @@ func main() {
 		numTests    int
 		pingDelay   int
 		maxFail     int
+		bwDelay     int
+		bwSize      int64
 		servePort   int
+		udpPort     int
 		serveReport int
 		myLocation  string
 		myHost      string
 		peerIP      string
+		proto       string
+		proxy       string
+		sources     string
+		family      string
+		resolver    string
+		labels      string
+		anomaly     float64
+		quorum      int
+		configFile  string
 		cwFlag      bool
+		simFlag     bool
+		seed        int64
 		vf, v2, qf  bool
 		verbose     int = 1
 	)
 
 	flag.IntVar(&pingDelay, "d", 10, "delay in seconds between ping requests")
 	flag.IntVar(&maxFail, "f", 100, "maximum failures before pinger quits trying")
+	flag.IntVar(&bwDelay, "b", 0, "delay in seconds between bandwidth probes of pingmesh peers (default 0 is off)")
+	flag.Int64Var(&bwSize, "z", 1000000, "bytes to transfer each way in a bandwidth probe")
 	flag.IntVar(&servePort, "s", 0, "server listen port; default zero means don't run a server")
+	flag.IntVar(&udpPort, "u", 0, "UDP echo responder port for udp:// probes; default zero means off")
 	flag.IntVar(&serveReport, "r", 0, "server port to report as SrvPort (Rafay translates ports in edge)")
 	flag.IntVar(&numTests, "n", 0, "number of tests to each endpoint (default 0 runs until interrupted)")
 	flag.BoolVar(&cwFlag, "c", false, "publish metrics to CloudWatch")
+	flag.BoolVar(&simFlag, "sim", false, "simulate the ping schedule: skip the delays, report virtual times")
+	flag.Int64Var(&seed, "seed", 0, "random seed for ping delay jitter (default 0 uses the time)")
 	flag.BoolVar(&vf, "v", false, "be more verbose")
 	flag.BoolVar(&v2, "V", false, "be even more verbose")
 	flag.BoolVar(&qf, "q", false, "be less verbose")
 	flag.StringVar(&myLocation, "L", "", "HTTP client's location to report")
 	flag.StringVar(&myHost, "H", "", "My hostname (should resolve to accessible IPs)")
 	flag.StringVar(&peerIP, "I", "", "remote peer IP address override")
+	flag.StringVar(&proto, "P", "h1", "HTTP protocol for pings: h1, h2, h2c or auto")
+	flag.StringVar(&proxy, "x", "", "proxy for HTTP pings: http://host:port (CONNECT) or socks5://host:port")
+	flag.StringVar(&sources, "S", "", "comma-separated source IPs or interfaces to ping each target from")
+	flag.StringVar(&family, "F", "", "address family for pings: ipv4, ipv6 or both (default either)")
+	flag.Float64Var(&anomaly, "A", 0, "flag TCP RTTs over this many times their baseline as anomalies, like 3 (default 0 is off)")
+	flag.IntVar(&quorum, "Q", 0, "vantage points that must see a target down to alert (default 0 is a majority)")
+	flag.StringVar(&labels, "l", "", "comma-separated key:value labels for this server, like region:us-west,provider:aws")
+	flag.StringVar(&resolver, "R", "", "DNS resolver host[:port] for probe lookups, cached by record TTL except for HTTP pings, which time each lookup (default the system resolver)")
+	flag.StringVar(&configFile, "C", "", "JSON file of peers to ping, with per-peer options")
 
 	flag.Usage = printUsage
 	flag.Parse()
@@ -106,6 +134,10 @@ func main() {
 		}
 	}
 
+	if labelEnv, found := os.LookupEnv("PINGMESH_LABELS"); found && len(labels) == 0 {
+		labels = labelEnv
+	}
+
 	hostEnv := os.Getenv("PINGMESH_HOSTNAME")
 	if len(myHost) == 0 {
 		myHost = hostEnv // if also be empty no DNS lookup is done
@@ -157,6 +189,10 @@ func main() {
 		}
 	}
 
+	if len(resolver) > 0 {
+		client.DefaultResolver = client.NewResolver(resolver)
+	}
+
 	////
 	// https://sentry.io -- Initialize sentry and generate an error
 	client.SentryInit()
@@ -173,7 +209,7 @@ func main() {
 		endpoints = append(endpoints, urlEnv)
 	}
 
-	if len(endpoints) == 0 {
+	if len(endpoints) == 0 && len(configFile) == 0 {
 		if servePort == 0 {
 			printUsage()
 			return
@@ -186,6 +222,58 @@ func main() {
 		os.Exit(1)
 	}
 
+	if seed != 0 {
+		pm.SetRandSeed(seed)
+	}
+	if err := client.ValidTransferSize(bwSize); err != nil {
+		log.Println("-z:", err)
+		os.Exit(1)
+	}
+	pm.SetBandwidthProbe(bwDelay, bwSize)
+	pm.SetAnomalyFactor(anomaly)
+	pm.SetQuorum(quorum)
+	if geo, err := client.GeoFromEnv(); err != nil {
+		log.Println("location:", err)
+		os.Exit(1)
+	} else {
+		pm.SetGeo(geo)
+	}
+	if srvLabels, err := server.ParseLabels(labels); err != nil {
+		log.Println("labels:", err)
+		os.Exit(1)
+	} else {
+		pm.SetLabels(srvLabels)
+	}
+	if !pm.SetProto(proto) {
+		log.Println("unknown HTTP protocol", proto)
+		os.Exit(1)
+	}
+	if err := pm.SetProxy(proxy); err != nil {
+		log.Println("proxy:", err)
+		os.Exit(1)
+	}
+	if !pm.SetFamily(family) {
+		log.Println("unknown address family", family)
+		os.Exit(1)
+	}
+	if len(sources) > 0 {
+		if err := pm.SetSources(strings.Split(sources, ",")); err != nil {
+			log.Println("sources:", err)
+			os.Exit(1)
+		}
+	}
+	if udpPort > 0 {
+		if _, err := pm.StartUDPEcho(fmt.Sprintf(":%d", udpPort)); err != nil {
+			log.Println("UDP echo responder:", err)
+			os.Exit(1)
+		}
+	}
+	if simFlag {
+		clock := server.NewVirtualClock(time.Now().UTC())
+		pm.SetClock(clock)
+		go pm.Simulate(clock)
+	}
+
 	////
 	// Set up signal handler thread to close down Pinger goroutines gracefully
 	sigchan := make(chan os.Signal, 1)
@@ -209,6 +297,17 @@ func main() {
 		close(sigchan)
 	}()
 
+	if len(configFile) > 0 {
+		n, err := pm.LoadPeers(configFile)
+		if err != nil {
+			log.Println("loading", configFile, "failed:", err)
+			os.Exit(1)
+		}
+		if verbose > 1 {
+			log.Println("added", n, "peers from", configFile)
+		}
+	}
+
 	if len(endpoints) > 0 && verbose > 0 {
 		if verbose > 1 {
 			log.Println("starting ping across", endpoints)
@@ -3,10 +3,10 @@ module github.com/rafayopen/pingmesh
 go 1.12
 
 require (
-	github.com/aws/aws-sdk-go v1.21.7 // indirect
+	github.com/aws/aws-sdk-go v1.21.7
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/getsentry/sentry-go v0.3.0
 	github.com/rafayopen/perftest v0.1.1
-	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80 // indirect
+	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80
 	golang.org/x/text v0.3.2 // indirect
 )
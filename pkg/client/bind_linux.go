@@ -0,0 +1,26 @@
+package client
+
+import (
+	"net"
+	"syscall"
+)
+
+func canBindToDevice() error {
+	return nil
+}
+
+////
+//  bindToDevice makes d's sockets send through the interface named ifname
+//  (SO_BINDTODEVICE), whatever the routing table says.  Before Linux 5.7
+//  this needs CAP_NET_RAW.
+func bindToDevice(d *net.Dialer, ifname string) {
+	d.Control = func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, ifname)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+func canBindToDevice() error {
+	return errors.New("binding to an interface needs Linux, use its IP address")
+}
+
+func bindToDevice(d *net.Dialer, ifname string) {}
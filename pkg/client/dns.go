@@ -0,0 +1,326 @@
+package client
+
+import (
+	"github.com/rafayopen/perftest/pkg/pt"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTimeout   = 5 * time.Second
+	dnsMaxUDP    = 1232 // EDNS-less responses are at most 512, but be generous
+	dnsMaxTCP    = 65535
+	dnsMaxAnswer = 64 // answer records kept to compare between probes
+)
+
+////
+//  DNSStats describes the response to one dns:// probe query
+type DNSStats struct {
+	Proto     string        // "udp" or "tcp" (after a truncated UDP reply)
+	Latency   time.Duration // query sent to response received
+	Rcode     string        // NOERROR, NXDOMAIN, SERVFAIL ...
+	Answers   int           // number of records in the answer section
+	Truncated bool          `json:",omitempty"` // UDP reply had TC set, retried over TCP
+	Records   []string      `json:",omitempty"` // sorted answer data, to detect changes
+	Changed   bool          `json:",omitempty"` // set by the pinger if Records differ from the last probe
+}
+
+var dnsTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"PTR":   dnsmessage.TypePTR,
+	"SOA":   dnsmessage.TypeSOA,
+	"SRV":   dnsmessage.TypeSRV,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "NOERROR",
+	dnsmessage.RCodeFormatError:    "FORMERR",
+	dnsmessage.RCodeServerFailure:  "SERVFAIL",
+	dnsmessage.RCodeNameError:      "NXDOMAIN",
+	dnsmessage.RCodeNotImplemented: "NOTIMP",
+	dnsmessage.RCodeRefused:        "REFUSED",
+}
+
+func rcodeName(rc dnsmessage.RCode) string {
+	if n, ok := rcodeNames[rc]; ok {
+		return n
+	}
+	return "RCODE" + strconv.Itoa(int(rc))
+}
+
+////
+//  fetchDNS sends one query for the name in the path of a
+//  dns://resolver[:port]/name URL directly to that resolver.  The query
+//  string can set type= (A by default, or AAAA, CNAME, MX, NS, PTR, SOA,
+//  SRV, TXT) and proto=tcp to query over TCP instead of UDP; a truncated UDP
+//  reply is retried over TCP.  DnsLk is the system lookup of the resolver's
+//  own name (if it is not an IP), TcpHs is the handshake over TCP or the
+//  query latency over UDP, and Reply is the query latency over TCP.  RespCode
+//  is 0 if the resolver answered NOERROR, else HttpUnknown.
+func fetchDNS(u *url.URL, rmtIP string, o *Options) *FetchResult {
+	urlStr := u.String()
+	qname := strings.Trim(u.Path, "/")
+	if len(qname) == 0 {
+		log.Println("dns target needs a name to look up:", urlStr)
+		return nil
+	}
+	qs := u.Query()
+	qtype := dnsmessage.TypeA
+	if t := strings.ToUpper(qs.Get("type")); len(t) > 0 {
+		var ok bool
+		if qtype, ok = dnsTypes[t]; !ok {
+			log.Println("dns target has unknown query type:", urlStr)
+			return nil
+		}
+	}
+	proto := "udp"
+	if strings.ToLower(qs.Get("proto")) == "tcp" {
+		proto = "tcp"
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = "53"
+	}
+
+	status := HttpUnknown
+	location := LocUnknown
+	var remoteIP string
+	var stats *DNSStats
+	var size int64
+
+	tStart := time.Now().UTC()
+	tDnsLk := tStart
+	host, lookup, err := o.lookupHost(u.Hostname(), rmtIP)
+	tDnsLk = time.Now().UTC()
+	if err != nil {
+		log.Printf("dns resolver lookup %s: %v", u.Hostname(), err)
+	}
+	tTcpHs, tFirst := tDnsLk, tDnsLk
+
+	if len(host) > 0 {
+		query, id, err := dnsQuery(qname, qtype)
+		if err != nil {
+			log.Printf("dns query %s: %v", urlStr, err)
+			return nil
+		}
+		addr := net.JoinHostPort(host, port)
+		for {
+			var resp []byte
+			var hs, rtt time.Duration
+			resp, hs, rtt, remoteIP, err = dnsExchange(o, proto, addr, query, id)
+			tTcpHs = tDnsLk.Add(hs)
+			tFirst = tTcpHs.Add(rtt)
+			if err != nil {
+				log.Printf("dns %s %s: %v", proto, urlStr, err)
+				break
+			}
+			size = int64(len(resp))
+			truncated := stats != nil && stats.Truncated
+			stats, err = dnsParse(resp)
+			if err != nil {
+				log.Printf("dns reply %s: %v", urlStr, err)
+				break
+			}
+			stats.Proto = proto
+			stats.Latency = rtt
+			if stats.Truncated && proto == "udp" {
+				proto = "tcp"
+				continue
+			}
+			stats.Truncated = stats.Truncated || truncated
+			if stats.Rcode == "NOERROR" {
+				status = 0
+			}
+			break
+		}
+	}
+	tClose := time.Now().UTC()
+
+	if proto == "udp" {
+		// no handshake: report the query round trip as the RTT
+		tTcpHs = tFirst
+	}
+	p := pt.PingTimes{
+		Start:    tStart,
+		DnsLk:    tDnsLk.Sub(tStart),
+		TcpHs:    tTcpHs.Sub(tDnsLk),
+		Reply:    tFirst.Sub(tTcpHs),
+		Close:    tClose.Sub(tFirst),
+		Total:    tClose.Sub(tDnsLk),
+		DestUrl:  &urlStr,
+		Location: &location,
+		Remote:   remoteIP,
+		RespCode: status,
+		Size:     size,
+	}
+	return &FetchResult{PingTimes: p, DNS: stats, Lookup: lookup}
+}
+
+////
+//  dnsQuery builds a recursive query for name and qtype, returning the
+//  message and its ID
+func dnsQuery(name string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: n, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	b, err := msg.Pack()
+	return b, id, err
+}
+
+////
+//  dnsExchange sends query to addr over proto and returns the response with
+//  the matching ID, the handshake time (TCP only), the query round trip time
+//  and the remote IP.
+func dnsExchange(o *Options, proto, addr string, query []byte, id uint16) (resp []byte, hs, rtt time.Duration, remoteIP string, err error) {
+	t0 := time.Now()
+	dialer, err := o.dialer(proto, dnsTimeout)
+	var conn net.Conn
+	if err == nil {
+		conn, err = dialer.Dial(o.network(proto), addr)
+	}
+	if err != nil {
+		return nil, time.Since(t0), 0, "", err
+	}
+	defer conn.Close()
+	if proto == "tcp" {
+		hs = time.Since(t0)
+	}
+	remoteIP = HostNoPort(conn.RemoteAddr().String())
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	t1 := time.Now()
+	if proto == "tcp" {
+		// RFC 1035 section 4.2.2: two byte length prefix
+		buf := make([]byte, 2+len(query))
+		binary.BigEndian.PutUint16(buf, uint16(len(query)))
+		copy(buf[2:], query)
+		if _, err = conn.Write(buf); err != nil {
+			return nil, hs, time.Since(t1), remoteIP, err
+		}
+		var lenbuf [2]byte
+		if _, err = io.ReadFull(conn, lenbuf[:]); err != nil {
+			return nil, hs, time.Since(t1), remoteIP, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(lenbuf[:]))
+		_, err = io.ReadFull(conn, resp)
+		rtt = time.Since(t1)
+		if err == nil && !dnsIDMatches(resp, id) {
+			err = errors.New("reply ID does not match query")
+		}
+		return resp, hs, rtt, remoteIP, err
+	}
+
+	if _, err = conn.Write(query); err != nil {
+		return nil, hs, time.Since(t1), remoteIP, err
+	}
+	buf := make([]byte, dnsMaxUDP)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, hs, time.Since(t1), remoteIP, err
+		}
+		if dnsIDMatches(buf[:n], id) {
+			return buf[:n], hs, time.Since(t1), remoteIP, nil
+		}
+		// a stray or late reply to someone else: keep waiting
+	}
+}
+
+func dnsIDMatches(msg []byte, id uint16) bool {
+	return len(msg) >= 2 && binary.BigEndian.Uint16(msg) == id
+}
+
+////
+//  dnsParse extracts the stats from a DNS response message
+func dnsParse(msg []byte) (*DNSStats, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	stats := &DNSStats{Rcode: rcodeName(h.RCode), Truncated: h.Truncated}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	answers, err := p.AllAnswers()
+	if err != nil && !h.Truncated {
+		return nil, err
+	}
+	stats.Answers = len(answers)
+	for _, a := range answers {
+		if len(stats.Records) >= dnsMaxAnswer {
+			break
+		}
+		stats.Records = append(stats.Records, dnsRecord(a))
+	}
+	sort.Strings(stats.Records)
+	return stats, nil
+}
+
+////
+//  dnsRecord formats the data of an answer record, without the TTL, so
+//  records can be compared between probes
+func dnsRecord(r dnsmessage.Resource) string {
+	switch b := r.Body.(type) {
+	case *dnsmessage.AResource:
+		return net.IP(b.A[:]).String()
+	case *dnsmessage.AAAAResource:
+		return net.IP(b.AAAA[:]).String()
+	case *dnsmessage.CNAMEResource:
+		return b.CNAME.String()
+	case *dnsmessage.NSResource:
+		return b.NS.String()
+	case *dnsmessage.PTRResource:
+		return b.PTR.String()
+	case *dnsmessage.MXResource:
+		return fmt.Sprintf("%d %s", b.Pref, b.MX)
+	case *dnsmessage.SRVResource:
+		return fmt.Sprintf("%d %d %d %s", b.Priority, b.Weight, b.Port, b.Target)
+	case *dnsmessage.SOAResource:
+		return fmt.Sprintf("%s %s %d", b.NS, b.MBox, b.Serial)
+	case *dnsmessage.TXTResource:
+		return strings.Join(b.TXT, "")
+	}
+	return r.Header.Type.String()
+}
+
+////
+//  SameRecords is true if two DNS probes returned the same answer data
+func SameRecords(a, b *DNSStats) bool {
+	if len(a.Records) != len(b.Records) || a.Answers != b.Answers {
+		return false
+	}
+	for i := range a.Records {
+		if a.Records[i] != b.Records[i] {
+			return false
+		}
+	}
+	return true
+}
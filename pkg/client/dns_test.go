@@ -0,0 +1,139 @@
+package client
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeDNS answers A queries for ok.test. with 10.0.0.1 and 10.0.0.2, and
+// for local.test. with 127.0.0.1, truncates (over UDP) any answer for
+// big.test., and NXDOMAINs the rest
+func fakeDNS(t *testing.T, query []byte, udp bool) []byte {
+	var m dnsmessage.Message
+	if err := m.Unpack(query); err != nil {
+		t.Error("fake dns:", err)
+		return nil
+	}
+	q := m.Questions[0]
+	m.Header.Response = true
+	switch q.Name.String() {
+	case "ok.test.", "big.test.":
+		if udp && q.Name.String() == "big.test." {
+			m.Header.Truncated = true
+			break
+		}
+		for _, ip := range [][4]byte{{10, 0, 0, 2}, {10, 0, 0, 1}} {
+			m.Answers = append(m.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: ip},
+			})
+		}
+	case "local.test.":
+		if q.Type == dnsmessage.TypeA {
+			m.Answers = append(m.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			})
+		}
+	default:
+		m.Header.RCode = dnsmessage.RCodeNameError
+	}
+	b, err := m.Pack()
+	if err != nil {
+		t.Error("fake dns:", err)
+	}
+	return b
+}
+
+func TestFetchDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	addr := pc.LocalAddr().String()
+	l, err := net.Listen("tcp", addr) // same port number for TCP
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(fakeDNS(t, buf[:n], true), from)
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var lenbuf [2]byte
+			io.ReadFull(c, lenbuf[:])
+			query := make([]byte, binary.BigEndian.Uint16(lenbuf[:]))
+			io.ReadFull(c, query)
+			resp := fakeDNS(t, query, false)
+			binary.BigEndian.PutUint16(lenbuf[:], uint16(len(resp)))
+			c.Write(append(lenbuf[:], resp...))
+			c.Close()
+		}
+	}()
+
+	cases := []struct {
+		url       string
+		respCode  int
+		proto     string
+		rcode     string
+		answers   int
+		truncated bool
+	}{
+		{"dns://" + addr + "/ok.test", 0, "udp", "NOERROR", 2, false},
+		{"dns://" + addr + "/ok.test?type=a&proto=tcp", 0, "tcp", "NOERROR", 2, false},
+		{"dns://" + addr + "/big.test", 0, "tcp", "NOERROR", 2, true},
+		{"dns://" + addr + "/missing.test", HttpUnknown, "udp", "NXDOMAIN", 0, false},
+	}
+	for n, c := range cases {
+		r := Fetch(c.url, "")
+		if r == nil || r.DNS == nil {
+			t.Error("case", n, "got", r)
+			continue
+		}
+		s := r.DNS
+		if r.RespCode != c.respCode || s.Proto != c.proto || s.Rcode != c.rcode ||
+			s.Answers != c.answers || s.Truncated != c.truncated {
+			t.Errorf("case %d: resp %d stats %+v", n, r.RespCode, *s)
+		}
+		if s.Latency <= 0 || r.TcpHs <= 0 || r.Remote != "127.0.0.1" {
+			t.Error("case", n, "latency", s.Latency, "rtt", r.TcpHs, "remote", r.Remote)
+		}
+		if c.answers == 2 && strings.Join(s.Records, ",") != "10.0.0.1,10.0.0.2" {
+			t.Error("case", n, "records", s.Records)
+		}
+	}
+
+	for _, bad := range []string{
+		"dns://" + addr + "/",               // no name
+		"dns://" + addr + "/ok.test?type=Q", // unknown type
+	} {
+		if r := Fetch(bad, ""); r != nil {
+			t.Error(bad, "got", r)
+		}
+	}
+
+	a := &DNSStats{Answers: 2, Records: []string{"10.0.0.1", "10.0.0.2"}}
+	b := &DNSStats{Answers: 2, Records: []string{"10.0.0.1", "10.0.0.3"}}
+	if !SameRecords(a, a) || SameRecords(a, b) {
+		t.Error("SameRecords")
+	}
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+////
+//  Expect holds assertions about an HTTP response.  A response that fails
+//  one is reported in FetchResult.Assert, separately from transport and
+//  HTTP errors, so an error page or captive portal that answers 200 is not
+//  taken for a healthy target.  The body checks see the first 64KB.
+type Expect struct {
+	Status   []int             `json:",omitempty"` // allowed status codes (default: any up to 304)
+	Contains string            `json:",omitempty"` // substring the body must contain
+	Regexp   string            `json:",omitempty"` // regular expression the body must match
+	JSON     map[string]string `json:",omitempty"` // dotted path (like "data.0.status") to expected value
+	MaxBody  int64             `json:",omitempty"` // largest acceptable body, in bytes
+	Header   map[string]string `json:",omitempty"` // required headers, with a value to contain (or "")
+
+	once sync.Once
+	re   *regexp.Regexp
+	err  error
+}
+
+////
+//  Compile checks that the assertions are usable (the Regexp parses)
+func (e *Expect) Compile() error {
+	if e == nil {
+		return nil
+	}
+	e.once.Do(func() {
+		if len(e.Regexp) > 0 {
+			e.re, e.err = regexp.Compile(e.Regexp)
+		}
+	})
+	return e.err
+}
+
+////
+//  StatusOK is true if code is a successful response: one of e.Status if
+//  that is set, else any code up to 304 (as for peers without assertions)
+func (e *Expect) StatusOK(code int) bool {
+	if e == nil || len(e.Status) == 0 {
+		return code <= 304
+	}
+	for _, s := range e.Status {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+////
+//  Check returns the first assertion that resp fails, or nil.  body is
+//  the start of the response body and size its full length.
+func (e *Expect) Check(resp *http.Response, body []byte, size int64) error {
+	if e == nil {
+		return nil
+	}
+	if err := e.Compile(); err != nil {
+		return err
+	}
+	if len(e.Status) > 0 && !e.StatusOK(resp.StatusCode) {
+		return fmt.Errorf("status %d, want one of %v", resp.StatusCode, e.Status)
+	}
+	if e.MaxBody > 0 && size > e.MaxBody {
+		return fmt.Errorf("body is %d bytes, want at most %d", size, e.MaxBody)
+	}
+	for name, want := range e.Header {
+		got, ok := resp.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return fmt.Errorf("no %s header", name)
+		}
+		if len(want) > 0 && !strings.Contains(strings.Join(got, ", "), want) {
+			return fmt.Errorf("header %s is %q, want %q", name, strings.Join(got, ", "), want)
+		}
+	}
+	if len(e.Contains) > 0 && !strings.Contains(string(body), e.Contains) {
+		return fmt.Errorf("body does not contain %q", e.Contains)
+	}
+	if e.re != nil && !e.re.Match(body) {
+		return fmt.Errorf("body does not match %q", e.Regexp)
+	}
+	if len(e.JSON) > 0 {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return fmt.Errorf("body is not JSON: %v", err)
+		}
+		for path, want := range e.JSON {
+			got, ok := jsonPath(doc, path)
+			if !ok {
+				return fmt.Errorf("no JSON %s", path)
+			}
+			if got != want {
+				return fmt.Errorf("JSON %s is %q, want %q", path, got, want)
+			}
+		}
+	}
+	return nil
+}
+
+////
+//  jsonPath finds the value at a dotted path in a decoded JSON document,
+//  where numeric elements index arrays, and formats it as a string
+func jsonPath(doc interface{}, path string) (string, bool) {
+	for _, elem := range strings.Split(path, ".") {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if doc, ok = v[elem]; !ok {
+				return "", false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(elem)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", false
+			}
+			doc = v[i]
+		default:
+			return "", false
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case nil:
+		return "null", true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b), true
+	}
+	return fmt.Sprint(doc), true
+}
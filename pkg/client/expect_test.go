@@ -0,0 +1,53 @@
+package client
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExpect(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": {"application/json"}, "X-Served-By": {"edge-7"}},
+	}
+	body := []byte(`{"status": "ok", "items": [{"id": 7}, {"id": 1000000}], "up": true, "err": null}`)
+	size := int64(len(body))
+
+	cases := []struct {
+		expect *Expect
+		fail   string // substring of the error, "" for none
+	}{
+		{nil, ""},
+		{&Expect{}, ""},
+		{&Expect{Status: []int{200, 204}}, ""},
+		{&Expect{Status: []int{204}}, "status 200"},
+		{&Expect{Contains: `"ok"`}, ""},
+		{&Expect{Contains: "Sign in to Wi-Fi"}, "does not contain"},
+		{&Expect{Regexp: `"id": \d+`}, ""},
+		{&Expect{Regexp: `^<html`}, "does not match"},
+		{&Expect{JSON: map[string]string{"status": "ok", "items.1.id": "1000000", "up": "true", "err": "null"}}, ""},
+		{&Expect{JSON: map[string]string{"items.0": `{"id":7}`}}, ""},
+		{&Expect{JSON: map[string]string{"status": "degraded"}}, `is "ok"`},
+		{&Expect{JSON: map[string]string{"items.2.id": "7"}}, "no JSON"},
+		{&Expect{MaxBody: size}, ""},
+		{&Expect{MaxBody: size - 1}, "at most"},
+		{&Expect{Header: map[string]string{"x-served-by": "edge"}}, ""},
+		{&Expect{Header: map[string]string{"X-Served-By": "origin"}}, "want"},
+		{&Expect{Header: map[string]string{"Strict-Transport-Security": ""}}, "no Strict"},
+		{&Expect{Regexp: "("}, "missing closing"},
+	}
+	for n, c := range cases {
+		err := c.expect.Check(resp, body, size)
+		if (err == nil) != (c.fail == "") || (err != nil && !strings.Contains(err.Error(), c.fail)) {
+			t.Error("case", n, "got", err, "want", c.fail)
+		}
+	}
+
+	if !(*Expect)(nil).StatusOK(301) || (*Expect)(nil).StatusOK(404) || !(&Expect{Status: []int{404}}).StatusOK(404) {
+		t.Error("StatusOK")
+	}
+	if err := (&Expect{JSON: map[string]string{"a": "b"}}).Check(resp, []byte("<html>"), 6); err == nil {
+		t.Error("want error for a body that is not JSON")
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// IP address families for Options.Family
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+////
+//  ValidFamily is true if family is a supported Options.Family: "" (either
+//  family, as the resolver and Happy Eyeballs choose), FamilyIPv4 or
+//  FamilyIPv6
+func ValidFamily(family string) bool {
+	switch family {
+	case "", FamilyIPv4, FamilyIPv6:
+		return true
+	}
+	return false
+}
+
+////
+//  IPFamily returns the address family of ip (which may be in brackets, as
+//  in Remote), or "" if it is not an IP address
+func IPFamily(ip string) string {
+	addr := net.ParseIP(strings.Trim(ip, "[]"))
+	switch {
+	case addr == nil:
+		return ""
+	case addr.To4() != nil:
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+////
+//  network returns network ("tcp" or "udp") restricted to o.Family
+func (o *Options) network(network string) string {
+	if o != nil {
+		switch o.Family {
+		case FamilyIPv4:
+			return network + "4"
+		case FamilyIPv6:
+			return network + "6"
+		}
+	}
+	return network
+}
+
+////
+//  lookupHost returns the address to dial for host: rmtIP if set, host
+//  itself if it is an IP address, or else the first address in o.Family
+//  (either family if unset) that DefaultResolver has for it.  Probes other
+//  than HTTP use it, and dial o.network, so they keep to the family.  It
+//  also returns how a name was looked up, LookupCached or LookupFresh, for
+//  FetchResult.Lookup.
+func (o *Options) lookupHost(host, rmtIP string) (string, string, error) {
+	if len(rmtIP) > 0 {
+		return rmtIP, "", nil
+	}
+	if net.ParseIP(host) != nil {
+		return host, "", nil
+	}
+	e, cached := DefaultResolver.lookupEntry(context.Background(), host)
+	lookup := LookupFresh
+	if cached {
+		lookup = LookupCached
+	}
+	addrs, err := e.addrs, e.err
+	if err != nil {
+		return "", lookup, err
+	}
+	var family string
+	if o != nil {
+		family = o.Family
+	}
+	for _, a := range addrs {
+		if len(family) == 0 || IPFamily(a.IP.String()) == family {
+			return a.IP.String(), lookup, nil
+		}
+	}
+	if len(family) == 0 {
+		return "", lookup, fmt.Errorf("no addresses for %s", host)
+	}
+	return "", lookup, fmt.Errorf("no %s addresses for %s", family, host)
+}
+
+////
+//  fellBack is true if a connection to remoteIP, after a lookup that
+//  returned addrs, was a Happy Eyeballs fallback: the name has addresses in
+//  both families, and the dialer, which tries the family of the first
+//  address first, connected with the other one.
+func fellBack(addrs []net.IPAddr, remoteIP string) bool {
+	if len(addrs) == 0 {
+		return false
+	}
+	first := IPFamily(addrs[0].IP.String())
+	used := IPFamily(remoteIP)
+	if used == "" || used == first {
+		return false
+	}
+	for _, a := range addrs {
+		if IPFamily(a.IP.String()) == used {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFellBack(t *testing.T) {
+	both := []net.IPAddr{{IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("192.0.2.1")}}
+	if !fellBack(both, "192.0.2.1") || fellBack(both, "2001:db8::1") {
+		t.Error("dual-stack name")
+	}
+	if fellBack(both[1:], "192.0.2.1") || fellBack(nil, "192.0.2.1") || fellBack(both, "") {
+		t.Error("single-family name, no lookup or no connection")
+	}
+}
+
+func TestFetchFamily(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hs.Close()
+	byName := strings.Replace(hs.URL, "127.0.0.1", "localhost", 1)
+
+	r := FetchWith(byName, "", &Options{Family: FamilyIPv4})
+	if r == nil || r.RespCode != 200 || r.Family != FamilyIPv4 || r.Fallback {
+		t.Error("ipv4 got", r)
+	}
+	// the server only listens on IPv4
+	if r = FetchWith(byName, "", &Options{Family: FamilyIPv6}); r == nil || r.RespCode != HttpUnknown {
+		t.Error("ipv6 got", r)
+	}
+
+	// tcp:// and the other probes keep to the family too
+	tcp := "tcp://" + strings.TrimPrefix(byName, "http://")
+	if r = FetchWith(tcp, "", &Options{Family: FamilyIPv4}); r == nil || r.RespCode != 0 || IPFamily(r.Remote) != FamilyIPv4 {
+		t.Error("tcp ipv4 got", r)
+	}
+	if r = FetchWith(tcp, "", &Options{Family: FamilyIPv6}); r == nil || r.RespCode != HttpUnknown {
+		t.Error("tcp ipv6 got", r)
+	}
+
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback:", err)
+	}
+	hs6 := httptest.NewUnstartedServer(hs.Config.Handler)
+	hs6.Listener = ln
+	hs6.Start()
+	defer hs6.Close()
+	if r = FetchWith(hs6.URL, "", &Options{Family: FamilyIPv6}); r == nil || r.RespCode != 200 || r.Family != FamilyIPv6 {
+		t.Error("ipv6 literal got", r)
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	earthRadiusKm = 6371.0
+	fiberKmPerSec = 299792.458 / 1.468 // light in single mode fiber (refractive index 1.468)
+)
+
+////
+//  Geo is a structured location: the parts of a Location string like
+//  "Sunnyvale,US", plus a region code and coordinates when they are known
+type Geo struct {
+	City    string  `json:",omitempty"`
+	Country string  `json:",omitempty"` // ISO 3166 code
+	Region  string  `json:",omitempty"` // e.g., a cloud region or state code
+	Lat     float64 `json:",omitempty"` // degrees north
+	Lon     float64 `json:",omitempty"` // degrees east
+}
+
+////
+//  GeoFromEnv returns the location described by REP_CITY, REP_COUNTRY,
+//  REP_REGION and REP_LATLON ("37.37,-122.04"), or nil if none is set
+func GeoFromEnv() (*Geo, error) {
+	g := &Geo{
+		City:    os.Getenv("REP_CITY"),
+		Country: os.Getenv("REP_COUNTRY"),
+		Region:  os.Getenv("REP_REGION"),
+	}
+	if ll := os.Getenv("REP_LATLON"); len(ll) > 0 {
+		var err error
+		if g.Lat, g.Lon, err = ParseLatLon(ll); err != nil {
+			return nil, errors.New("REP_LATLON: " + err.Error())
+		}
+	}
+	if *g == (Geo{}) {
+		return nil, nil
+	}
+	return g, nil
+}
+
+////
+//  ParseLatLon parses coordinates written "lat,lon" in decimal degrees
+func ParseLatLon(s string) (lat, lon float64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, errors.New("want lat,lon: " + s)
+	}
+	if lat, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64); err != nil {
+		return 0, 0, err
+	}
+	if lon, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+		return 0, 0, err
+	}
+	if math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return 0, 0, errors.New("coordinates out of range: " + s)
+	}
+	return lat, lon, nil
+}
+
+////
+//  HasCoords is true if the location has coordinates.  (0,0, in the Gulf
+//  of Guinea, is taken to mean none.)
+func (g *Geo) HasCoords() bool {
+	return g != nil && (g.Lat != 0 || g.Lon != 0)
+}
+
+////
+//  DistanceKm returns the great-circle distance between two locations
+//  with coordinates, by the haversine formula
+func DistanceKm(a, b *Geo) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLon := (b.Lon - a.Lon) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+////
+//  MinRtt returns the round trip time of light in fiber over km, a floor
+//  that no path of that great-circle distance can beat
+func MinRtt(km float64) time.Duration {
+	return time.Duration(2 * km / fiberKmPerSec * float64(time.Second))
+}
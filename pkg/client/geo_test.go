@@ -0,0 +1,33 @@
+package client
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDistance(t *testing.T) {
+	sf := &Geo{City: "San Francisco", Country: "US", Lat: 37.7749, Lon: -122.4194}
+	nyc := &Geo{City: "New York", Country: "US", Lat: 40.7128, Lon: -74.0060}
+	if km := DistanceKm(sf, nyc); math.Abs(km-4129) > 5 {
+		t.Error("SF to NYC is about 4129 km, got", km)
+	}
+	if km := DistanceKm(sf, sf); km != 0 {
+		t.Error("distance to self", km)
+	}
+	if rtt := MinRtt(4129); rtt < 40*time.Millisecond || rtt > 41*time.Millisecond {
+		t.Error("SF to NYC floor", rtt)
+	}
+
+	if lat, lon, err := ParseLatLon(" 37.37, -122.04"); err != nil || lat != 37.37 || lon != -122.04 {
+		t.Error("ParseLatLon got", lat, lon, err)
+	}
+	for _, bad := range []string{"37.37", "north,west", "91,0", "0,181"} {
+		if _, _, err := ParseLatLon(bad); err == nil {
+			t.Error("ParseLatLon", bad, "want error")
+		}
+	}
+	if (&Geo{City: "Null Island"}).HasCoords() || (*Geo)(nil).HasCoords() || !sf.HasCoords() {
+		t.Error("HasCoords")
+	}
+}
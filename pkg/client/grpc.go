@@ -0,0 +1,375 @@
+package client
+
+import (
+	"github.com/rafayopen/perftest/pkg/pt"
+
+	"golang.org/x/net/http2"
+
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////
+//  gRPC over HTTP/2, by hand: the two messages pingmesh needs are simple
+//  enough that pulling in the grpc and protobuf modules is not worth it.
+//  See https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+const (
+	GRPCContentType = "application/grpc"
+	GRPCHealthCheck = "/grpc.health.v1.Health/Check"
+	GRPCMeshPing    = "/pingmesh.v1.Mesh/Ping"
+
+	grpcTimeout    = 30 * time.Second
+	grpcMaxMessage = 1 << 16
+)
+
+// grpc.health.v1.HealthCheckResponse.ServingStatus
+const (
+	HealthUnknown        = 0
+	HealthServing        = 1
+	HealthNotServing     = 2
+	HealthServiceUnknown = 3
+)
+
+var healthNames = []string{"UNKNOWN", "SERVING", "NOT_SERVING", "SERVICE_UNKNOWN"}
+
+////
+//  GRPCStats describes the response to a grpc:// probe
+type GRPCStats struct {
+	Method  string // full method name called
+	Code    int    // grpc-status, 0 is OK
+	Message string `json:",omitempty"` // grpc-message, if any
+	Health  string `json:",omitempty"` // SERVING, NOT_SERVING ... for health checks
+}
+
+////
+//  fetchGRPC calls a gRPC service at grpc://host:port/service (plaintext
+//  HTTP/2) or grpcs://host:port/service (HTTP/2 over TLS).  A single path
+//  element names the service for a grpc.health.v1.Health/Check call (an
+//  empty path checks the server as a whole); the path /pingmesh.v1.Mesh/Ping
+//  calls a pingmesh server's ping service, which returns its location and
+//  timestamps.  RespCode is 0 if the call succeeded and the service is
+//  SERVING, 503 if the service is not serving (or unknown), or HttpUnknown
+//  on a transport or gRPC error.
+func fetchGRPC(u *url.URL, rmtIP string, o *Options) *FetchResult {
+	urlStr := u.String()
+	useTLS := u.Scheme == "grpcs"
+	method := GRPCHealthCheck
+	service := strings.Trim(u.Path, "/")
+	if "/"+service == GRPCMeshPing {
+		method, service = GRPCMeshPing, ""
+	} else if strings.Contains(service, "/") {
+		log.Println("grpc target path must be a service name or", GRPCMeshPing, ":", urlStr)
+		return nil
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if useTLS {
+			port = "443"
+		}
+	}
+
+	status := HttpUnknown
+	location := LocUnknown
+	var remoteIP string
+	var size int64
+	var pong *PongTimes
+	stats := &GRPCStats{Method: method, Code: -1}
+
+	tStart := time.Now().UTC()
+	tDnsLk := tStart
+	host, lookup, err := o.lookupHost(u.Hostname(), rmtIP)
+	tDnsLk = time.Now().UTC()
+	if err != nil {
+		log.Printf("grpc lookup %s: %v", u.Hostname(), err)
+	}
+	tTcpHs, tTlsHs, tSent, tFirst := tDnsLk, tDnsLk, tDnsLk, tDnsLk
+
+	if len(host) > 0 {
+		tr := &http2.Transport{
+			AllowHTTP: !useTLS,
+			DialTLS: func(network, _ string, cfg *tls.Config) (net.Conn, error) {
+				dialer, err := o.dialer("tcp", grpcTimeout)
+				if err != nil {
+					return nil, err
+				}
+				conn, err := dialer.Dial(o.network(network), net.JoinHostPort(host, port))
+				tTcpHs = time.Now().UTC()
+				tTlsHs = tTcpHs
+				if err != nil || !useTLS {
+					return conn, err
+				}
+				remoteIP = HostNoPort(conn.RemoteAddr().String())
+				cfg = cfg.Clone()
+				cfg.ServerName = u.Hostname()
+				cfg.InsecureSkipVerify = true // as with https, ping doesn't care
+				tc := tls.Client(conn, cfg)
+				err = tc.Handshake()
+				tTlsHs = time.Now().UTC()
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tc, nil
+			},
+		}
+		defer tr.CloseIdleConnections()
+
+		scheme := "http"
+		if useTLS {
+			scheme = "https"
+		}
+		var msg []byte
+		if method == GRPCHealthCheck {
+			msg = ProtoString(nil, 1, service)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), grpcTimeout)
+		defer cancel()
+		req, _ := http.NewRequest(http.MethodPost, scheme+"://"+u.Host+method, bytes.NewReader(GRPCFrame(msg)))
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", GRPCContentType)
+		req.Header.Set("TE", "trailers")
+
+		tSent = time.Now().UTC()
+		resp, err := tr.RoundTrip(req)
+		tFirst = time.Now().UTC()
+		if err != nil {
+			log.Printf("grpc call %s: %v", urlStr, err)
+		} else {
+			if len(remoteIP) == 0 {
+				remoteIP = host
+			}
+			reply, n, err := readGRPCReply(resp, stats)
+			size = n
+			switch {
+			case err != nil:
+				log.Printf("grpc reply %s: %v", urlStr, err)
+			case stats.Code != 0:
+				log.Printf("grpc %s: status %d %s", urlStr, stats.Code, stats.Message)
+			case method == GRPCHealthCheck:
+				hs := ProtoFields(reply)[1]
+				if int(hs) < len(healthNames) {
+					stats.Health = healthNames[hs]
+				} else {
+					stats.Health = strconv.Itoa(int(hs))
+				}
+				status = http.StatusServiceUnavailable
+				if hs == HealthServing {
+					status = 0
+				}
+			default: // GRPCMeshPing
+				status = 0
+				var mp Pong
+				if ParseMeshPing(reply, &mp) == nil {
+					location = mp.SrvLoc
+					if mp.Recv != 0 {
+						pong = &PongTimes{T1: tSent, T2: time.Unix(0, mp.Recv).UTC(), T3: time.Unix(0, mp.Send).UTC(), T4: tFirst}
+					}
+				}
+			}
+		}
+	}
+	tClose := time.Now().UTC()
+
+	p := pt.PingTimes{
+		Start:    tStart,
+		DnsLk:    tDnsLk.Sub(tStart),
+		TcpHs:    tTcpHs.Sub(tDnsLk),
+		TlsHs:    tTlsHs.Sub(tTcpHs),
+		Reply:    tFirst.Sub(tSent), // RPC latency, to response headers
+		Close:    tClose.Sub(tFirst),
+		Total:    tClose.Sub(tDnsLk),
+		DestUrl:  &urlStr,
+		Location: &location,
+		Remote:   remoteIP,
+		RespCode: status,
+		Size:     size,
+	}
+	return &FetchResult{PingTimes: p, Pong: pong, GRPC: stats, Lookup: lookup}
+}
+
+////
+//  readGRPCReply reads the single response message and the grpc-status,
+//  which is a trailer (or a header, in a trailers-only error response).
+//  It returns the message and the number of body bytes read.
+func readGRPCReply(resp *http.Response, stats *GRPCStats) ([]byte, int64, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, errors.New("HTTP status " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, grpcMaxMessage+5))
+	if err != nil {
+		return nil, int64(len(body)), err
+	}
+	gs := resp.Trailer.Get("Grpc-Status")
+	if len(gs) == 0 {
+		gs = resp.Header.Get("Grpc-Status")
+		stats.Message = resp.Header.Get("Grpc-Message")
+	} else {
+		stats.Message = resp.Trailer.Get("Grpc-Message")
+	}
+	if stats.Code, err = strconv.Atoi(gs); err != nil {
+		stats.Code = -1
+		return nil, int64(len(body)), errors.New("no grpc-status in response")
+	}
+	if stats.Code != 0 {
+		return nil, int64(len(body)), nil
+	}
+	msg, err := ReadGRPCFrame(bytes.NewReader(body))
+	return msg, int64(len(body)), err
+}
+
+////
+//  GRPCFrame prefixes msg with the gRPC length-prefixed message header
+//  (uncompressed)
+func GRPCFrame(msg []byte) []byte {
+	b := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	copy(b[5:], msg)
+	return b
+}
+
+////
+//  ReadGRPCFrame reads one length-prefixed message from r
+func ReadGRPCFrame(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, errors.New("compressed grpc message not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > grpcMaxMessage {
+		return nil, errors.New("grpc message too large")
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+////
+//  Protocol buffer encoding, just the varint and string fields used here
+
+////
+//  ProtoVarint appends a varint field to b
+func ProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3) // wire type 0
+	return appendUvarint(b, v)
+}
+
+////
+//  ProtoString appends a string field to b, unless s is empty (the default)
+func ProtoString(b []byte, field int, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = appendUvarint(b, uint64(field)<<3|2) // wire type 2
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+////
+//  ProtoFields decodes the varint fields of a message by field number,
+//  skipping others.  It stops at the first malformed field.
+func ProtoFields(msg []byte) map[int]uint64 {
+	fields := make(map[int]uint64)
+	protoWalk(msg, func(field int, v uint64, _ []byte) { fields[field] = v })
+	return fields
+}
+
+////
+//  protoWalk calls f for each varint (v) or length-delimited (b) field
+func protoWalk(msg []byte, f func(field int, v uint64, b []byte)) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("bad protobuf key")
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return errors.New("bad protobuf varint")
+			}
+			msg = msg[n:]
+			f(field, v, nil)
+		case 2:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return errors.New("bad protobuf length")
+			}
+			f(field, 0, msg[n:n+int(l)])
+			msg = msg[n+int(l):]
+		case 1:
+			if len(msg) < 8 {
+				return errors.New("bad protobuf fixed64")
+			}
+			msg = msg[8:]
+		case 5:
+			if len(msg) < 4 {
+				return errors.New("bad protobuf fixed32")
+			}
+			msg = msg[4:]
+		default:
+			return errors.New("unsupported protobuf wire type")
+		}
+	}
+	return nil
+}
+
+////
+//  MeshPing encodes a pingmesh.v1.Mesh/Ping reply:
+//    message PingReply { string location = 1; int64 recv = 2; int64 send = 3; }
+//  with the times in Unix nanoseconds, as in the JSON Pong.
+func MeshPing(p *Pong) []byte {
+	b := ProtoString(nil, 1, p.SrvLoc)
+	b = ProtoVarint(b, 2, uint64(p.Recv))
+	return ProtoVarint(b, 3, uint64(p.Send))
+}
+
+////
+//  ParseMeshPing decodes a pingmesh.v1.Mesh/Ping reply into p
+func ParseMeshPing(msg []byte, p *Pong) error {
+	return protoWalk(msg, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			p.SrvLoc = string(b)
+		case 2:
+			p.Recv = int64(v)
+		case 3:
+			p.Send = int64(v)
+		}
+	})
+}
+
+////
+//  ParseHealthCheck returns the service named in a
+//  grpc.health.v1.HealthCheckRequest { string service = 1; }
+func ParseHealthCheck(msg []byte) (service string, err error) {
+	err = protoWalk(msg, func(field int, _ uint64, b []byte) {
+		if field == 1 {
+			service = string(b)
+		}
+	})
+	return
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMeshPingProto(t *testing.T) {
+	in := Pong{SrvLoc: "Here,US", Recv: 1500000000123456789, Send: 1500000000123999999}
+	var out Pong
+	if err := ParseMeshPing(MeshPing(&in), &out); err != nil || !reflect.DeepEqual(out, in) {
+		t.Error("got", out, err, "want", in)
+	}
+
+	msg, err := ReadGRPCFrame(bytes.NewReader(GRPCFrame(ProtoString(nil, 1, "svc"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc, err := ParseHealthCheck(msg); svc != "svc" || err != nil {
+		t.Error("health check service", svc, err)
+	}
+	if _, err := ParseHealthCheck([]byte{0x0a, 0x05, 'x'}); err == nil {
+		t.Error("want error for truncated string")
+	}
+}
+
+func TestFetchGRPCS(t *testing.T) {
+	// a TLS health service that is not serving
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != GRPCHealthCheck || r.ProtoMajor != 2 {
+			t.Error("request", r.Proto, r.URL.Path)
+		}
+		w.Header().Set("Content-Type", GRPCContentType)
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write(GRPCFrame(ProtoVarint(nil, 1, HealthNotServing)))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	r := Fetch(strings.Replace(ts.URL, "https", "grpcs", 1)+"/my.Service", "")
+	if r == nil || r.GRPC == nil {
+		t.Fatal("got", r)
+	}
+	if r.RespCode != http.StatusServiceUnavailable || r.GRPC.Health != "NOT_SERVING" || r.TlsHs <= 0 {
+		t.Error("resp", r.RespCode, "tls", r.TlsHs, "stats", *r.GRPC)
+	}
+}
@@ -1,30 +1,25 @@
 package client
 
 import (
+	"context"
 	"net"
-	"time"
-)
-
-var (
-	myIPs   []net.IP
-	fetched time.Time
-	ipTTL   time.Duration = time.Second
 )
 
+////
+//  GetIPs returns the IP addresses of hostname (such as this server's own
+//  name), looked up through DefaultResolver, or nil if it has none.  If a
+//  refresh fails it keeps returning the addresses found before.
 func GetIPs(hostname string) []net.IP {
-	if len(myIPs) > 0 && time.Since(fetched) < ipTTL {
-		return myIPs
+	if len(hostname) == 0 {
+		return nil
 	}
-
-	if len(hostname) > 0 {
-		if ips, err := net.LookupIP(hostname); err == nil {
-			myIPs = ips
-		}
-		fetched = time.Now()
-		if ipTTL < time.Hour {
-			ipTTL = 2 * ipTTL
-		}
+	addrs, err := DefaultResolver.LookupStale(context.Background(), hostname)
+	if err != nil {
+		return nil
 	}
-
-	return myIPs
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
 }
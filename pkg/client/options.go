@@ -0,0 +1,152 @@
+package client
+
+import (
+	"golang.org/x/net/http2"
+
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+)
+
+// HTTP protocols for Options.Proto
+const (
+	ProtoH1   = "h1"   // HTTP/1.1 only (the default)
+	ProtoH2   = "h2"   // HTTP/2 over TLS, required
+	ProtoH2C  = "h2c"  // HTTP/2 without TLS, with prior knowledge
+	ProtoAuto = "auto" // HTTP/2 if the server negotiates it, else HTTP/1.1
+)
+
+// UserAgent is sent with every pingmesh HTTP request, unless overridden
+const UserAgent = "pingmesh-client"
+
+////
+//  Options change how FetchWith makes HTTP requests (and Source applies to
+//  tcp://, udp://, dns:// and grpc:// probes too).  The zero value makes the
+//  same request as Fetch.
+type Options struct {
+	Proto  string            // ProtoH1 (or ""), ProtoH2, ProtoH2C or ProtoAuto
+	Method string            // request method, GET if empty
+	Header map[string]string // request headers; "Host" overrides the Host header
+	Body   string            // request body, if any
+	Expect *Expect           // assertions about the response, if any
+
+	FollowRedirects int // most redirects to follow, 0 to time the redirect itself
+
+	Proxy  string // HTTP CONNECT or SOCKS5 proxy URL (see ValidProxy), if any
+	Source string // IP address or interface name to send from (see ValidSource), if any
+	Family string // FamilyIPv4 or FamilyIPv6 to connect only over that, "" for either
+}
+
+func (o *Options) expect() *Expect {
+	if o == nil {
+		return nil
+	}
+	return o.Expect
+}
+
+func (o *Options) proxy() string {
+	if o == nil {
+		return ""
+	}
+	return o.Proxy
+}
+
+func (o *Options) maxRedirects() int {
+	if o == nil || o.FollowRedirects < 0 {
+		return 0
+	}
+	return o.FollowRedirects
+}
+
+////
+//  newRequest makes the request for urlStr with o's method, headers and body
+func (o *Options) newRequest(urlStr string) (*http.Request, error) {
+	method := http.MethodGet
+	var body io.Reader
+	if o != nil {
+		if len(o.Method) > 0 {
+			method = strings.ToUpper(o.Method)
+		}
+		if len(o.Body) > 0 {
+			body = strings.NewReader(o.Body)
+		}
+	}
+	req, err := http.NewRequest(method, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	if o != nil {
+		for name, value := range o.Header {
+			if strings.EqualFold(name, "Host") {
+				req.Host = value
+			} else {
+				req.Header.Set(name, value)
+			}
+		}
+	}
+	return req, nil
+}
+
+////
+//  ValidProto is true if proto is a supported Options.Proto.  There is no
+//  HTTP/3 mode: it needs a QUIC implementation, which is not in the module
+//  graph.
+func ValidProto(proto string) bool {
+	switch proto {
+	case "", ProtoH1, ProtoH2, ProtoH2C, ProtoAuto:
+		return true
+	}
+	return false
+}
+
+////
+//  roundTripper returns the transport for o.Proto, starting from the
+//  HTTP/1.1 transport tr.  The h2c transport dials peerAddr itself (with
+//  dial), so it reports the connection to trace.
+func (o *Options) roundTripper(tr *http.Transport, scheme, peerAddr string, dial dialFunc, trace *httptrace.ClientTrace) http.RoundTripper {
+	proto := ProtoH1
+	if o != nil && len(o.Proto) > 0 {
+		proto = o.Proto
+	}
+	if proto == ProtoH2 && scheme == "http" {
+		proto = ProtoH2C // no TLS to negotiate with
+	}
+
+	switch proto {
+	case ProtoH2, ProtoAuto:
+		// a custom DialContext and TLSClientConfig turn off HTTP/2 unless
+		// the transport is configured for it
+		if err := http2.ConfigureTransport(tr); err != nil {
+			return tr
+		}
+		if proto == ProtoH2 {
+			tr.TLSClientConfig.NextProtos = []string{"h2"}
+		}
+	case ProtoH2C:
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, _ string, _ *tls.Config) (net.Conn, error) {
+				trace.ConnectStart(network, peerAddr)
+				conn, err := dial(context.Background(), o.network(network), peerAddr)
+				addr := peerAddr
+				if err == nil {
+					addr = conn.RemoteAddr().String()
+				}
+				trace.ConnectDone(network, addr, err)
+				return conn, err
+			},
+		}
+	}
+	return tr
+}
+
+////
+//  needH2 is true if o.Proto requires HTTP/2
+func (o *Options) needH2() bool {
+	return o != nil && (o.Proto == ProtoH2 || o.Proto == ProtoH2C)
+}
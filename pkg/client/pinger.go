@@ -28,6 +28,11 @@ const (
 
 	HttpUnknown = 502
 	LocUnknown  = "unknown"
+
+	// requests to this path ask for a JSON Pong response
+	pongPath = "/v1/ping"
+	// how much of a ping response body to keep for parsing
+	maxPingBody = 64 * 1024
 )
 
 var (
@@ -98,12 +103,59 @@ func MakePeerAddr(scheme, host, rmtIP string) (newhost, peerAddr string) {
 	return
 }
 
+////
+//  FetchResult holds the PingTimes from a Fetch along with the extra data
+//  that some targets return.
+type FetchResult struct {
+	pt.PingTimes
+	Pong *PongTimes // timestamps from a pingmesh peer's JSON ping response
+	UDP  *UDPStats  // results of a udp:// probe
+	DNS  *DNSStats  // results of a dns:// probe
+	GRPC *GRPCStats // results of a grpc:// probe
+	WS   *WSStats   // results of a ws:// probe
+	Geo  *Geo       // location of a pingmesh peer, from its JSON ping response
+
+	Verdicts map[string]string // a pingmesh peer's health verdicts on its own targets
+	Node     string            // a pingmesh peer's node ID, from its JSON ping response
+
+	Proto    string         // HTTP protocol of the response, like "HTTP/2.0"
+	Assert   string         // the assertion (see Expect) the response failed, if any
+	Redirect *RedirectStats // the redirects followed, if Options allow them
+	Proxy    *ProxyStats    // the proxy used, if Options set one
+	Family   string         // address family of the HTTP connection, FamilyIPv4 or FamilyIPv6
+	Fallback bool           // the connection fell back to the name's other address family
+	Lookup   string         // how a probe other than HTTP resolved its name: LookupCached or LookupFresh
+}
+
 // FetchURL makes an HTTP request to the given URL, reads and discards the response
 // body, and returns a PingTimes object with detailed timing information from the fetch.
 // NOTE: the location handling is different from perftest!  The caller does
 // not pass in a location, instead location is parsed from the response body
 // and returned in pt.Location.
 func FetchURL(rawurl, rmtIP string) *pt.PingTimes {
+	r := Fetch(rawurl, rmtIP)
+	if r == nil {
+		return nil
+	}
+	return &r.PingTimes
+}
+
+// Fetch is FetchURL returning a FetchResult.  Requests to a pingmesh
+// /v1/ping endpoint ask for a JSON response, and if the peer supplies its
+// timestamps they are returned in Pong.  Non-HTTP URL schemes select other
+// probe types: tcp://host:port (see tcp.go), udp://host:port (udp.go),
+// dns://resolver/name (dns.go), grpc://host:port/service (grpc.go) and
+// ws://host/path (ws.go; Fetch opens a new connection each call, a
+// WSSession holds one open).
+func Fetch(rawurl, rmtIP string) *FetchResult {
+	return FetchWith(rawurl, rmtIP, nil)
+}
+
+// FetchWith is Fetch with Options for HTTP requests (nil for the defaults).
+// The protocol of the response is returned in Proto; if opts require
+// HTTP/2 and the server did not negotiate it, the request fails.  If opts
+// allow redirects they are followed (see redirect.go).
+func FetchWith(rawurl, rmtIP string, opts *Options) *FetchResult {
 	// Leveraged from https://github.com/reorx/httpstat
 	url := ParseURL(rawurl)
 	if url == nil {
@@ -111,22 +163,57 @@ func FetchURL(rawurl, rmtIP string) *pt.PingTimes {
 		return nil
 	}
 
+	switch url.Scheme {
+	case "tcp":
+		return fetchTCP(url, rmtIP, opts)
+	case "udp":
+		return fetchUDP(url, rmtIP, opts)
+	case "dns":
+		return fetchDNS(url, rmtIP, opts)
+	case "grpc", "grpcs":
+		return fetchGRPC(url, rmtIP, opts)
+	case "ws", "wss":
+		s := NewWSSession(rawurl)
+		defer s.Close()
+		return s.FetchWith(rmtIP, opts)
+	}
+
+	host := url.Host
+	result, next := fetchHTTP(url, rmtIP, opts)
+	if result == nil || next == nil || opts.maxRedirects() == 0 {
+		return result
+	}
+	return followRedirects(result, next, host, rmtIP, opts)
+}
+
+////
+//  fetchHTTP makes one HTTP request, without following redirects.  If the
+//  response is a redirect it also returns the URL it points to.
+func fetchHTTP(url *url.URL, rmtIP string, opts *Options) (result *FetchResult, next *url.URL) {
 	urlStr := url.Scheme + "://" + url.Host + url.Path
+	if len(url.RawQuery) > 0 {
+		urlStr += "?" + url.RawQuery // e.g., pingmesh size= or delay= options
+	}
 
 	var peerAddr string
 	url.Host, peerAddr = MakePeerAddr(url.Scheme, url.Host, rmtIP)
 
-	httpMethod := http.MethodGet
-
-	req, err := http.NewRequest(httpMethod, urlStr, nil)
+	req, err := opts.newRequest(urlStr)
 	if err != nil {
 		log.Printf("create request: %v", err)
-		return nil
+		return nil, nil
+	}
+
+	wantPong := strings.HasSuffix(url.Path, pongPath)
+	if wantPong && len(req.Header.Get("Accept")) == 0 {
+		req.Header.Set("Accept", "application/json")
 	}
 
 	var remoteIP string
+	var dnsAddrs []net.IPAddr // for Happy Eyeballs fallback
 
 	var tStart, tDnsLk, tTcpHs, tConnd, tFirst, tTlsSt, tTlsHs, tClose time.Time
+	var tSent time.Time // request written (for Pong)
 
 	tStart = time.Now().UTC()
 
@@ -134,6 +221,7 @@ func FetchURL(rawurl, rmtIP string) *pt.PingTimes {
 		DNSStart: func(_ httptrace.DNSStartInfo) { tStart = time.Now().UTC() },
 		DNSDone: func(i httptrace.DNSDoneInfo) {
 			tDnsLk = time.Now().UTC()
+			dnsAddrs = i.Addrs
 		},
 		ConnectStart: func(_, _ string) {
 			if tDnsLk.IsZero() {
@@ -168,14 +256,27 @@ func FetchURL(rawurl, rmtIP string) *pt.PingTimes {
 		},
 
 		GotConn:              func(_ httptrace.GotConnInfo) { tConnd = time.Now().UTC() },
+		WroteRequest:         func(_ httptrace.WroteRequestInfo) { tSent = time.Now().UTC() },
 		GotFirstResponseByte: func() { tFirst = time.Now().UTC() },
 	}
 	req = req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
 
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
-		DualStack: true,
+	dialer, err := opts.dialer("tcp", 30*time.Second)
+	if err != nil {
+		log.Printf("%s: %v", urlStr, err)
+		return nil, nil
+	}
+	dialer.KeepAlive = 30 * time.Second
+	dialer.DualStack = true
+	dialer.Resolver = DefaultResolver.NetResolver() // uncached, so DnsLk is timed
+	dial := dialFunc(dialer.DialContext)
+	var proxied *ProxyStats // set if going through a proxy
+	if pu, err := parseProxy(opts.proxy()); err != nil {
+		log.Printf("proxy %s: %v", RedactURL(opts.proxy()), err)
+		return nil, nil
+	} else if pu != nil {
+		proxied = new(ProxyStats)
+		dial = proxyDial(pu, dialer, proxied)
 	}
 
 	tr := &http.Transport{
@@ -188,12 +289,12 @@ func FetchURL(rawurl, rmtIP string) *pt.PingTimes {
 			InsecureSkipVerify: true, // Warning: skips CA checks, but ping doesn't care
 		},
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialer.DialContext(ctx, network, peerAddr)
+			return dial(ctx, opts.network(network), peerAddr)
 		},
 	}
 
 	client := &http.Client{
-		Transport: tr,
+		Transport: opts.roundTripper(tr, url.Scheme, peerAddr, dial, trace),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// do not follow redirects; collect timing on the 301/302 instead
 			return http.ErrUseLastResponse
@@ -206,6 +307,10 @@ func FetchURL(rawurl, rmtIP string) *pt.PingTimes {
 	status := HttpUnknown
 	location := LocUnknown
 	var bytes int64
+	var pong *PongTimes
+	var geo *Geo
+	var verdicts map[string]string
+	var node, proto, assert string
 	resp, err := client.Do(req)
 	if resp != nil {
 		// Close body if non-nil, whatever err says (even if err non-nil)
@@ -230,13 +335,36 @@ func FetchURL(rawurl, rmtIP string) *pt.PingTimes {
 		}
 	} else {
 		status = resp.StatusCode
+		var body []byte
 		if status == 200 { // && IsPingmeshPeer(url.Path) {
-			location, bytes = readPingResp(req, resp)
+			location, bytes, body = readPingResp(req, resp)
+			if wantPong {
+				var srv *Pong
+				if pong, srv = parsePong(body, tSent, tFirst); srv != nil {
+					geo, verdicts, node = srv.Geo, srv.Verdicts, srv.Node
+				}
+			}
+		} else if opts.expect() != nil {
+			_, bytes, body = readPingResp(req, resp) // keep the body to check
 		} else {
 			bytes = readDiscardBody(req, resp)
 		}
+		if err := opts.expect().Check(resp, body, bytes); err != nil {
+			assert = err.Error()
+		}
+		proto = resp.Proto
+		if status >= 300 && status < 400 {
+			next, _ = resp.Location() // nil if no Location header
+		}
+		if opts.needH2() && resp.ProtoMajor != 2 {
+			log.Printf("%s: wanted HTTP/2, got %s", urlStr, resp.Proto)
+			status = HttpUnknown
+		}
 	}
 	tClose = time.Now().UTC() // after read body
+	if proxied != nil {
+		remoteIP = "" // we connected to the proxy
+	}
 
 	p := pt.PingTimes{
 		Start:    tStart,             // request start
@@ -253,7 +381,34 @@ func FetchURL(rawurl, rmtIP string) *pt.PingTimes {
 		Size:     bytes,
 	}
 
-	return &p
+	return &FetchResult{
+		PingTimes: p,
+		Pong:      pong,
+		Geo:       geo,
+		Verdicts:  verdicts,
+		Node:      node,
+		Proto:     proto,
+		Assert:    assert,
+		Proxy:     proxied,
+		Family:    IPFamily(remoteIP),
+		Fallback:  fellBack(dnsAddrs, remoteIP),
+	}, next
+}
+
+// parsePong returns the PongTimes and the Pong itself from a JSON ping
+// response body, or nil if the body has no server timestamps (e.g., an HTML
+// response).
+func parsePong(body []byte, sent, first time.Time) (*PongTimes, *Pong) {
+	pong := ParsePong(body)
+	if pong == nil || pong.Recv == 0 || sent.IsZero() {
+		return nil, nil
+	}
+	return &PongTimes{
+		T1: sent,
+		T2: time.Unix(0, pong.Recv).UTC(),
+		T3: time.Unix(0, pong.Send).UTC(),
+		T4: first,
+	}, pong
 }
 
 func IsPingmeshPeer(path string) bool {
@@ -265,20 +420,22 @@ func IsPingmeshPeer(path string) bool {
 	return false
 }
 
-// readPingResp consumes an HTML ping response body, expecting a location
-// string in the <title> and body.  Discards the remaining body.
-func readPingResp(req *http.Request, resp *http.Response) (location string, bytes int64) {
+// readPingResp consumes an HTML or JSON ping response body, expecting a
+// location string in the body, which it returns along with the body.
+func readPingResp(req *http.Request, resp *http.Response) (location string, bytes int64, body []byte) {
 	if req.Method == http.MethodHead {
 		log.Printf("no HTTP response body in a HEAD")
 		return
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	// keep the start of the body for parsing, and discard any bulk payload
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPingBody))
 	bytes = int64(len(body))
 	if err != nil {
 		log.Println("readPingResp:", err)
 		return
 	}
+	bytes += readDiscardBody(req, resp)
 
 	sb := string(body)
 
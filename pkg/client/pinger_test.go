@@ -1,6 +1,12 @@
 package client
 
 import (
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -46,6 +52,19 @@ func TestMakePeerAddr(t *testing.T) {
 }
 
 func TestFetchURL(t *testing.T) {
+	// local stand-ins for a site that redirects to its www name, and the www site
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusMovedPermanently)
+			return
+		}
+		w.Write([]byte(ServedFromPrefix + "testland" + ServedFromSuffix))
+	})
+	hs := httptest.NewServer(handler)
+	defer hs.Close()
+	tls := httptest.NewTLSServer(handler)
+	defer tls.Close()
+
 	cases := []struct {
 		url      string
 		ok       bool
@@ -56,9 +75,9 @@ func TestFetchURL(t *testing.T) {
 		{"http:/bad-url-oneslash", true, 502},
 		{"http://bad-hostname", true, 502},
 		{"https://bad-hostname", true, 502},
-		{"http://google.com", true, 301},
-		{"https://google.com", true, 301},
-		{"https://www.google.com", true, 200},
+		{hs.URL + "/redirect", true, 301},
+		{tls.URL + "/redirect", true, 301},
+		{tls.URL + "/", true, 200},
 	}
 
 	for n, c := range cases {
@@ -75,3 +94,85 @@ func TestFetchURL(t *testing.T) {
 		}
 	}
 }
+
+func TestFetchProto(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	hs := httptest.NewServer(handler) // HTTP/1.1 only
+	defer hs.Close()
+	h2c := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2c.Close()
+	tls := httptest.NewUnstartedServer(handler)
+	tls.EnableHTTP2 = true
+	tls.StartTLS()
+	defer tls.Close()
+
+	cases := []struct {
+		url, proto string
+		respCode   int
+		got        string
+	}{
+		{tls.URL, "", 200, "HTTP/1.1"},
+		{tls.URL, ProtoH1, 200, "HTTP/1.1"},
+		{tls.URL, ProtoAuto, 200, "HTTP/2.0"},
+		{tls.URL, ProtoH2, 200, "HTTP/2.0"},
+		{hs.URL, ProtoAuto, 200, "HTTP/1.1"},
+		{hs.URL, ProtoH2, HttpUnknown, ""}, // h2c to an HTTP/1.1 server
+		{h2c.URL, ProtoH2C, 200, "HTTP/2.0"},
+		{h2c.URL, ProtoH2, 200, "HTTP/2.0"},
+	}
+	for n, c := range cases {
+		r := FetchWith(c.url, "", &Options{Proto: c.proto})
+		if r == nil {
+			t.Error("case", n, "fetch failed")
+			continue
+		}
+		if r.RespCode != c.respCode || r.Proto != c.got {
+			t.Error("case", n, "got", r.RespCode, r.Proto, "want", c.respCode, c.got)
+		}
+		if c.respCode == 200 && (r.TcpHs <= 0 || len(r.Remote) == 0) {
+			t.Error("case", n, "tcp", r.TcpHs, "remote", r.Remote)
+		}
+	}
+
+	for _, proto := range []string{"", ProtoH1, ProtoH2, ProtoH2C, ProtoAuto} {
+		if !ValidProto(proto) {
+			t.Error(proto, "should be valid")
+		}
+	}
+	if ValidProto("h3") {
+		t.Error("h3 should not be valid")
+	}
+}
+
+func TestFetchOptions(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = ioutil.ReadAll(r.Body)
+		if r.Header.Get("Authorization") != "Bearer xyzzy" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer hs.Close()
+
+	r := Fetch(hs.URL+"/api", "")
+	if r == nil || r.RespCode != http.StatusUnauthorized || got.Method != "GET" || got.UserAgent() != UserAgent {
+		t.Fatal("default request", r, got.Method, got.UserAgent())
+	}
+
+	opts := &Options{
+		Method: "put",
+		Header: map[string]string{"Authorization": "Bearer xyzzy", "Host": "api.example.com", "User-Agent": "probe"},
+		Body:   `{"ping":true}`,
+	}
+	r = FetchWith(hs.URL+"/api", "", opts)
+	if r == nil || r.RespCode != 200 {
+		t.Fatal("got", r)
+	}
+	if got.Method != "PUT" || got.Host != "api.example.com" || got.UserAgent() != "probe" || string(body) != opts.Body {
+		t.Error("request", got.Method, got.Host, got.UserAgent(), string(body))
+	}
+}
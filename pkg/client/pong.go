@@ -0,0 +1,142 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+////
+//  Pong is the JSON response body of a pingmesh /v1/ping request made with
+//  "Accept: application/json".  Recv and Send are the server's wall clock
+//  times (Unix nanoseconds) when the request arrived and the reply left.
+//  Geo is the server's structured location, if it has one, and Verdicts
+//  its own view of its ping targets' health, by target (scheme and host,
+//  or the whole URL of a dns:// target), for other nodes to weigh (see
+//  the server's /v1/verdicts), with its Node ID, which tells nodes apart
+//  when they share a location.  Pad, if present, is filler
+//  requested with size= and always comes last, so ParsePong can read the
+//  rest from just the start of the body.
+type Pong struct {
+	SrvLoc   string
+	Recv     int64
+	Send     int64
+	Geo      *Geo              `json:",omitempty"`
+	Verdicts map[string]string `json:",omitempty"`
+	Node     string            `json:",omitempty"`
+	Pad      string            `json:",omitempty"`
+}
+
+////
+//  ParsePong decodes the Pong fields ahead of any Pad from the start of a
+//  JSON ping response body.  It returns nil if the body is not a Pong.
+func ParsePong(body []byte) *Pong {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil
+	}
+
+	var pong Pong
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		var dest interface{}
+		switch tok {
+		case "SrvLoc":
+			dest = &pong.SrvLoc
+		case "Recv":
+			dest = &pong.Recv
+		case "Send":
+			dest = &pong.Send
+		case "Geo":
+			dest = &pong.Geo
+		case "Verdicts":
+			dest = &pong.Verdicts
+		case "Node":
+			dest = &pong.Node
+		default: // Pad, or something newer than us: stop here
+			return &pong
+		}
+		if err := dec.Decode(dest); err != nil {
+			return nil
+		}
+	}
+	return &pong
+}
+
+////
+//  PongTimes holds the four timestamps of one ping, NTP style: T1 client
+//  send, T2 server receive, T3 server send, T4 client receive.  T1 and T4
+//  are on the client clock, T2 and T3 on the server clock.
+type PongTimes struct {
+	T1, T2, T3, T4 time.Time
+}
+
+////
+//  Offset estimates the server clock minus the client clock, assuming the
+//  forward and return delays are equal.
+func (p *PongTimes) Offset() time.Duration {
+	return (p.T2.Sub(p.T1) + p.T3.Sub(p.T4)) / 2
+}
+
+////
+//  Delay returns the round trip network delay, excluding server time
+func (p *PongTimes) Delay() time.Duration {
+	return p.T4.Sub(p.T1) - p.T3.Sub(p.T2)
+}
+
+const (
+	// number of recent samples to keep for the clock offset filter
+	oneWayWindow = 16
+)
+
+////
+//  OneWay estimates forward (client to server) and return delays from a
+//  series of PongTimes.  A single sample can not separate the two, since
+//  the clock offset is unknown.  Like NTP, we take the offset from the
+//  sample with the lowest round trip delay in the recent window (the one
+//  least affected by queueing, so most likely symmetric), then split each
+//  sample's delay using that offset.  Growth in Forward with a steady
+//  Return means the extra latency is on the outbound path, and vice versa.
+type OneWay struct {
+	Samples int           // number of samples seen
+	Offset  time.Duration // estimated server clock minus client clock
+	MinRtt  time.Duration // delay of the sample the Offset came from
+	Forward time.Duration // latest sample's client to server delay
+	Return  time.Duration // latest sample's server to client delay
+	FwdAvg  time.Duration // average Forward over the window
+	RetAvg  time.Duration // average Return over the window
+
+	window []PongTimes
+}
+
+////
+//  Add includes a new sample and updates the estimates
+func (o *OneWay) Add(p *PongTimes) {
+	o.Samples++
+	o.window = append(o.window, *p)
+	if len(o.window) > oneWayWindow {
+		o.window = o.window[len(o.window)-oneWayWindow:]
+	}
+
+	best := o.window[0]
+	for _, s := range o.window[1:] {
+		if s.Delay() < best.Delay() {
+			best = s
+		}
+	}
+	o.Offset = best.Offset()
+	o.MinRtt = best.Delay()
+
+	var fwd, ret time.Duration
+	for _, s := range o.window {
+		fwd += s.T2.Sub(s.T1) - o.Offset
+		ret += s.T4.Sub(s.T3) + o.Offset
+	}
+	o.FwdAvg = fwd / time.Duration(len(o.window))
+	o.RetAvg = ret / time.Duration(len(o.window))
+	o.Forward = p.T2.Sub(p.T1) - o.Offset
+	o.Return = p.T4.Sub(p.T3) + o.Offset
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOneWay(t *testing.T) {
+	ms := time.Millisecond
+	offset := 100 * ms // server clock is ahead
+	base := time.Unix(1000, 0)
+
+	// sample makes PongTimes for the given true forward and return delays
+	sample := func(i int, fwd, ret time.Duration) *PongTimes {
+		t1 := base.Add(time.Duration(i) * time.Second)
+		t2 := t1.Add(fwd + offset)
+		t3 := t2.Add(ms) // server think time
+		t4 := t3.Add(ret - offset)
+		return &PongTimes{t1, t2, t3, t4}
+	}
+
+	var o OneWay
+	o.Add(sample(0, 20*ms, 20*ms)) // symmetric, uncongested
+	if o.Offset != offset || o.MinRtt != 40*ms {
+		t.Fatal("offset", o.Offset, "minRtt", o.MinRtt)
+	}
+
+	// congestion on the outbound path only
+	o.Add(sample(1, 50*ms, 20*ms))
+	o.Add(sample(2, 80*ms, 20*ms))
+	if o.Offset != offset {
+		t.Error("offset moved to", o.Offset)
+	}
+	if o.Forward != 80*ms || o.Return != 20*ms {
+		t.Error("forward", o.Forward, "return", o.Return)
+	}
+	if o.FwdAvg != 50*ms || o.RetAvg != 20*ms {
+		t.Error("fwdAvg", o.FwdAvg, "retAvg", o.RetAvg)
+	}
+
+	// the min-delay sample ages out of the window
+	for i := 0; i < oneWayWindow; i++ {
+		o.Add(sample(3+i, 30*ms, 30*ms))
+	}
+	if o.Samples != 3+oneWayWindow || o.MinRtt != 60*ms || o.Offset != offset {
+		t.Error("samples", o.Samples, "minRtt", o.MinRtt, "offset", o.Offset)
+	}
+}
+
+func TestParsePong(t *testing.T) {
+	cases := []struct {
+		body string
+		ok   bool
+		loc  string
+		recv int64
+	}{
+		{`{"SrvLoc": "here", "Recv": 5, "Send": 6}`, true, "here", 5},
+		{`{"SrvLoc": "here", "Recv": 5, "Send": 6, "Geo": {"Lat": 1, "Lon": 2}, "Pad": "xx`, true, "here", 5},
+		{`{"SrvLoc": "here", "Recv": 5, "Send": 6, "Pad": "xxxxxxxx`, true, "here", 5}, // truncated pad
+		{`{"SrvLoc": "here", "Recv": 5, "Send": 6, "Node": "n1", "Pad": "xx`, true, "here", 5},
+		{`{"SrvLoc": "here", "Recv": 5, "Send"`, false, "", 0}, // truncated timestamps
+		{`<html><head><title>here</title>`, false, "", 0},
+		{`[1, 2]`, false, "", 0},
+	}
+	for n, c := range cases {
+		pong := ParsePong([]byte(c.body))
+		if (pong != nil) != c.ok {
+			t.Error("case", n, "got", pong)
+			continue
+		}
+		if pong != nil && (pong.SrvLoc != c.loc || pong.Recv != c.recv || pong.Send != 6 || n == 3 && pong.Node != "n1") {
+			t.Error("case", n, "got", *pong)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"golang.org/x/net/proxy"
+
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+////
+//  ProxyStats describes the proxy an HTTP request went through.  The
+//  request's TcpHs is then the handshake with the proxy, and its Remote is
+//  empty, since only the proxy knows the origin's address.
+type ProxyStats struct {
+	Proxy   string        // proxy URL, with any password hidden
+	Addr    string        // proxy IP address
+	Connect time.Duration // CONNECT request or SOCKS5 handshake, after the TCP handshake
+}
+
+////
+//  ValidProxy returns an error unless proxy is empty or a proxy URL that
+//  Options.Proxy supports: http://[user:pass@]host[:port] for an HTTP
+//  CONNECT proxy, or socks5://[user:pass@]host[:port]
+func ValidProxy(proxy string) error {
+	_, err := parseProxy(proxy)
+	return err
+}
+
+func parseProxy(proxy string) (*url.URL, error) {
+	if len(proxy) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if len(u.Hostname()) == 0 {
+		return nil, errors.New("proxy has no host")
+	}
+	if len(u.Port()) == 0 {
+		port := "8080"
+		if u.Scheme == "socks5" {
+			port = "1080"
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+////
+//  RedactURL returns rawurl with any password replaced by "xxxxx"
+func RedactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.User == nil {
+		return rawurl
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// dialFunc dials addr, like net.Dialer.DialContext
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+////
+//  proxyDial returns a dialFunc that reaches its target through the proxy
+//  pu, and fills in stats when it connects.  The TCP connection to the
+//  proxy is made with dialer and ctx, so an httptrace in ctx sees it.
+func proxyDial(pu *url.URL, dialer *net.Dialer, stats *ProxyStats) dialFunc {
+	stats.Proxy = RedactURL(pu.String())
+
+	// tcp dials the proxy, and starts timing the proxy's own handshake
+	var tConn time.Time
+	tcp := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		tConn = time.Now()
+		if err == nil {
+			stats.Addr = HostNoPort(conn.RemoteAddr().String())
+		}
+		return conn, err
+	}
+
+	if pu.Scheme == "socks5" {
+		var auth *proxy.Auth
+		if pu.User != nil {
+			pass, _ := pu.User.Password()
+			auth = &proxy.Auth{User: pu.User.Username(), Password: pass}
+		}
+		d, _ := proxy.SOCKS5("tcp", pu.Host, auth, contextDialer(tcp))
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+			if err == nil {
+				stats.Connect = time.Since(tConn)
+			}
+			return conn, err
+		}
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := tcp(ctx, network, pu.Host)
+		if err != nil {
+			return nil, err
+		}
+		if err = httpConnect(conn, pu, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		stats.Connect = time.Since(tConn)
+		return conn, nil
+	}
+}
+
+////
+//  httpConnect asks the HTTP proxy on conn for a tunnel to addr
+func httpConnect(conn net.Conn, pu *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	if pu.User != nil {
+		pass, _ := pu.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(pu.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy %s: CONNECT %s: %s", pu.Host, addr, resp.Status)
+	}
+	return nil
+}
+
+// contextDialer makes a dialFunc a proxy.ContextDialer
+type contextDialer dialFunc
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
@@ -0,0 +1,99 @@
+package client
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// connectProxy is an HTTP CONNECT proxy that counts the tunnels it makes
+func connectProxy(t *testing.T, tunnels *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != "Basic dTpw" { // u:p
+			http.Error(w, "no", http.StatusProxyAuthRequired)
+			return
+		}
+		origin, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		*tunnels++
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go splice(conn, origin)
+	}))
+}
+
+// socksProxy accepts SOCKS5 connects (no auth, IPv4 targets) on ln
+func socksProxy(ln net.Listener, tunnels *int) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 10)
+		io.ReadFull(conn, buf[:3])  // version, 1 method, no auth
+		conn.Write([]byte{5, 0})    // no auth
+		io.ReadFull(conn, buf[:10]) // version, connect, 0, IPv4, addr, port
+		ip := net.IP(buf[4:8]).String()
+		port := int(binary.BigEndian.Uint16(buf[8:10]))
+		origin, err := net.Dial("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		*tunnels++
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go splice(conn, origin)
+	}
+}
+
+func splice(a, b net.Conn) {
+	go func() { io.Copy(a, b); a.Close() }()
+	io.Copy(b, a)
+	b.Close()
+}
+
+func TestFetchProxy(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hs.Close()
+
+	var connects int
+	ps := connectProxy(t, &connects)
+	defer ps.Close()
+	pu := "http://u:p@" + ps.Listener.Addr().String()
+
+	r := FetchWith(hs.URL+"/", "", &Options{Proxy: pu})
+	if r == nil || r.RespCode != 200 || r.Proxy == nil || connects != 1 {
+		t.Fatal("CONNECT got", r, "tunnels", connects)
+	}
+	if r.Remote != "" || r.Proxy.Addr != "127.0.0.1" || r.Proxy.Connect <= 0 || r.Proxy.Proxy != "http://u:xxxxx@"+ps.Listener.Addr().String() {
+		t.Error("remote", r.Remote, "proxy", *r.Proxy)
+	}
+
+	r = FetchWith(hs.URL+"/", "", &Options{Proxy: "http://" + ps.Listener.Addr().String()})
+	if r == nil || r.RespCode == 200 {
+		t.Error("want failure without proxy credentials, got", r)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var socks int
+	go socksProxy(ln, &socks)
+	r = FetchWith(hs.URL+"/", "", &Options{Proxy: "socks5://" + ln.Addr().String()})
+	if r == nil || r.RespCode != 200 || r.Proxy == nil || r.Proxy.Connect <= 0 || socks != 1 {
+		t.Error("SOCKS5 got", r, "tunnels", socks)
+	}
+
+	if ValidProxy("ftp://proxy") == nil || ValidProxy("socks5://") == nil || ValidProxy("") != nil {
+		t.Error("ValidProxy")
+	}
+}
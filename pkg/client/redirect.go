@@ -0,0 +1,129 @@
+package client
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+////
+//  Hop describes one request in a redirect chain
+type Hop struct {
+	Url    string
+	Status int
+	Remote string        `json:",omitempty"` // server IP
+	DnsLk  time.Duration // DNS lookup
+	TcpHs  time.Duration // TCP handshake (0 if the connection was reused)
+	TlsHs  time.Duration // TLS handshake
+	Reply  time.Duration // first byte
+	Total  time.Duration // request time, not including DNS lookup
+}
+
+////
+//  RedirectStats describes the redirects followed by a request made with
+//  Options.FollowRedirects set
+type RedirectStats struct {
+	Hops    []Hop         // each request made, starting with the original URL
+	Final   string        // URL of the final response
+	Total   time.Duration // first request (after DNS lookup) to the end of the final response
+	TooMany bool          `json:",omitempty"` // the final response was another redirect
+}
+
+func newHop(r *FetchResult) Hop {
+	return Hop{
+		Url:    *r.DestUrl,
+		Status: r.RespCode,
+		Remote: r.Remote,
+		DnsLk:  r.DnsLk,
+		TcpHs:  r.TcpHs,
+		TlsHs:  r.TlsHs,
+		Reply:  r.Reply,
+		Total:  r.Total,
+	}
+}
+
+////
+//  followRedirects follows the redirect from result (a response from host)
+//  to next, and on, for up to opts.FollowRedirects hops.  The PingTimes
+//  returned are the final response's, except that Start and DnsLk are the
+//  first request's and Total covers the whole chain.  A chain that does not
+//  end within the limit, or leaves HTTP, fails with HttpUnknown.  The IP
+//  override rmtIP, a Host header and credentials are only sent to the
+//  original host, and a POST redirected by 301, 302 or 303 becomes a GET.
+func followRedirects(result *FetchResult, next *url.URL, host, rmtIP string, opts *Options) *FetchResult {
+	rs := &RedirectStats{Hops: []Hop{newHop(result)}}
+	first := result.PingTimes
+	o := *opts
+
+	for next != nil {
+		if len(rs.Hops) > o.FollowRedirects {
+			log.Printf("%s: more than %d redirects", *first.DestUrl, o.FollowRedirects)
+			rs.TooMany = true
+			result.RespCode = HttpUnknown
+			break
+		}
+		if next.Scheme != "http" && next.Scheme != "https" {
+			log.Printf("%s: redirect to %s", *result.DestUrl, next)
+			result.RespCode = HttpUnknown
+			break
+		}
+		if next.Host != host {
+			host = next.Host
+			rmtIP = ""
+			o.Header = crossHostHeader(o.Header)
+		}
+		switch result.RespCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+			if m := strings.ToUpper(o.Method); m != "" && m != http.MethodGet && m != http.MethodHead {
+				o.Method, o.Body = http.MethodGet, ""
+			}
+		}
+
+		result, next = fetchHTTP(next, rmtIP, &o)
+		if result == nil {
+			return nil
+		}
+		rs.Hops = append(rs.Hops, newHop(result))
+	}
+
+	end := result.Start.Add(result.DnsLk + result.Total)
+	rs.Final = *result.DestUrl
+	rs.Total = end.Sub(first.Start.Add(first.DnsLk))
+	result.Start, result.DnsLk, result.Total = first.Start, first.DnsLk, rs.Total
+	result.Redirect = rs
+	return result
+}
+
+////
+//  SecretHeader reports whether the header called name carries credentials:
+//  Authorization, Proxy-Authorization, Cookie, or a name with token,
+//  secret, key or password in it (like X-Api-Key or X-Auth-Token)
+func SecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie":
+		return true
+	}
+	for _, s := range []string{"token", "secret", "key", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+////
+//  crossHostHeader returns header without Host and the credentials (see
+//  SecretHeader), which should only go to the original host
+func crossHostHeader(header map[string]string) map[string]string {
+	out := make(map[string]string, len(header))
+	for name, value := range header {
+		if strings.EqualFold(name, "host") || SecretHeader(name) {
+			continue
+		}
+		out[name] = value
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFollowRedirects(t *testing.T) {
+	// /a -> /b (POST becomes GET) -> / on another host, which drops credentials
+	var method, auth, token, accept string
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, auth = r.Method, r.Header.Get("Authorization")
+		token, accept = r.Header.Get("X-Auth-Token"), r.Header.Get("Accept")
+	}))
+	defer final.Close()
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, final.URL+"/", http.StatusMovedPermanently)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer hs.Close()
+
+	// the default is to time the redirect itself
+	r := Fetch(hs.URL+"/a", "")
+	if r == nil || r.RespCode != http.StatusFound || r.Redirect != nil {
+		t.Fatal("no-follow got", r)
+	}
+
+	header := map[string]string{"Authorization": "Bearer xyzzy", "X-Auth-Token": "plugh", "Accept": "text/plain"}
+	opts := &Options{Method: "POST", Body: "x", Header: header, FollowRedirects: 5}
+	r = FetchWith(hs.URL+"/a", "", opts)
+	if r == nil || r.Redirect == nil {
+		t.Fatal("follow got", r)
+	}
+	rs := r.Redirect
+	if r.RespCode != 200 || len(rs.Hops) != 3 || rs.Final != final.URL+"/" || rs.TooMany {
+		t.Fatal("status", r.RespCode, "redirects", *rs)
+	}
+	if rs.Hops[0].Status != http.StatusFound || rs.Hops[1].Status != http.StatusMovedPermanently || rs.Hops[2].Status != 200 {
+		t.Error("hops", rs.Hops)
+	}
+	if r.Total != rs.Total || rs.Total < rs.Hops[0].Total+rs.Hops[2].Total {
+		t.Error("total", r.Total, rs.Total, "hops", rs.Hops)
+	}
+	if method != "GET" || auth != "" || token != "" || accept != "text/plain" {
+		t.Error("final request", method, "auth", auth, "token", token, "accept", accept)
+	}
+
+	opts = &Options{FollowRedirects: 2}
+	r = FetchWith(hs.URL+"/loop", "", opts)
+	if r == nil || r.RespCode != HttpUnknown || r.Redirect == nil || !r.Redirect.TooMany || len(r.Redirect.Hops) != 3 {
+		t.Error("loop got", r)
+	}
+}
@@ -0,0 +1,285 @@
+package client
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMinTTL = 5 * time.Second
+	defaultMaxTTL = time.Hour
+	defaultNegTTL = 30 * time.Second
+)
+
+// How a probe's lookup was answered, in FetchResult.Lookup
+const (
+	LookupCached = "cached" // from the cache, so DnsLk is about 0
+	LookupFresh  = "fresh"  // sent to the resolver, DnsLk is its latency
+)
+
+////
+//  Resolver looks up host addresses and caches them, keyed by hostname, for
+//  the TTL of their records bounded by MinTTL and MaxTTL.  Failed lookups
+//  are cached for NegTTL.  With Server set, A and AAAA queries go directly
+//  to that resolver, which reports the TTLs; the system resolver does not,
+//  so its answers are cached for MinTTL.  A Resolver is safe for
+//  concurrent use; set its fields before using it.
+type Resolver struct {
+	Server string        // resolver address, host[:port], or "" for the system resolver
+	MinTTL time.Duration // shortest time to cache an answer
+	MaxTTL time.Duration // longest time to cache an answer
+	NegTTL time.Duration // time to cache a failed lookup
+
+	mu    sync.Mutex
+	cache map[string]*resolved
+	stats ResolverStats
+	now   func() time.Time // for tests
+}
+
+////
+//  ResolverStats counts a Resolver's cache activity
+type ResolverStats struct {
+	Entries   int   // hostnames cached, including expired ones not yet looked up again
+	Hits      int64 // lookups answered from the cache
+	NegHits   int64 // lookups answered with a cached failure
+	Misses    int64 // lookups sent to the resolver
+	Errors    int64 // of the misses, those that failed
+	Evictions int64 // expired entries replaced by a new lookup
+}
+
+type resolved struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+	stale   []net.IPAddr // the last good answer, kept while refreshes fail
+}
+
+////
+//  DefaultResolver is used by GetIPs and to look up the targets of tcp://,
+//  udp://, dns://, grpc:// and ws:// probes.  HTTP pings and bandwidth
+//  transfers time a fresh lookup, DnsLk, on each request, but send it to
+//  its Server too (see NetResolver).  Replace it, if at all, before any
+//  lookups are made.
+var DefaultResolver = NewResolver("")
+
+////
+//  NewResolver returns a Resolver using server (host[:port], or "" for
+//  the system resolver) with the default TTL bounds: 5 seconds to an hour,
+//  and 30 seconds for failed lookups
+func NewResolver(server string) *Resolver {
+	return &Resolver{
+		Server: server,
+		MinTTL: defaultMinTTL,
+		MaxTTL: defaultMaxTTL,
+		NegTTL: defaultNegTTL,
+	}
+}
+
+////
+//  NetResolver returns a net.Resolver that sends its queries to r.Server,
+//  uncached, for a net.Dialer's Resolver, or nil (the system resolver) if
+//  r has no Server
+func (r *Resolver) NetResolver() *net.Resolver {
+	if len(r.Server) == 0 {
+		return nil
+	}
+	server := r.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+////
+//  LookupIPAddr returns the addresses of host, from the cache if it has an
+//  unexpired answer.  An IP address is returned as is.
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	e, _ := r.lookupEntry(ctx, host)
+	return e.addrs, e.err
+}
+
+////
+//  LookupStale is LookupIPAddr, except that if the lookup fails it returns
+//  the last addresses it found for host, if any, with no error
+func (r *Resolver) LookupStale(ctx context.Context, host string) ([]net.IPAddr, error) {
+	e, _ := r.lookupEntry(ctx, host)
+	if e.err != nil && len(e.stale) > 0 {
+		return e.stale, nil
+	}
+	return e.addrs, e.err
+}
+
+////
+//  lookupEntry returns the cache entry for host, looking it up if there
+//  is none or it has expired, and whether it came from the cache
+func (r *Resolver) lookupEntry(ctx context.Context, host string) (*resolved, bool) {
+	if ip := net.ParseIP(host); ip != nil {
+		return &resolved{addrs: []net.IPAddr{{IP: ip}}}, false
+	}
+
+	r.mu.Lock()
+	now := r.clock()
+	if e := r.cache[host]; e != nil && now.Before(e.expires) {
+		if e.err != nil {
+			r.stats.NegHits++
+		} else {
+			r.stats.Hits++
+		}
+		r.mu.Unlock()
+		return e, true
+	}
+	r.stats.Misses++
+	r.mu.Unlock()
+
+	// look up without the lock, so one slow name does not hold up the rest
+	addrs, ttl, err := r.lookup(ctx, host)
+	if err != nil {
+		ttl = r.NegTTL
+	} else if ttl < r.MinTTL {
+		ttl = r.MinTTL
+	} else if ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cache == nil {
+		r.cache = make(map[string]*resolved)
+	}
+	if err != nil {
+		r.stats.Errors++
+	}
+	e := &resolved{addrs: addrs, err: err, expires: now.Add(ttl)}
+	if prev, found := r.cache[host]; found {
+		r.stats.Evictions++
+		if err != nil {
+			e.stale = prev.stale
+			if prev.err == nil {
+				e.stale = prev.addrs
+			}
+		}
+	}
+	r.cache[host] = e
+	return e, false
+}
+
+////
+//  Stats returns a snapshot of the cache counters
+func (r *Resolver) Stats() ResolverStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := r.stats
+	stats.Entries = len(r.cache)
+	return stats
+}
+
+func (r *Resolver) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+////
+//  lookup asks the resolver for the addresses of host, returning them with
+//  the shortest TTL of the answer records (0 if unknown)
+func (r *Resolver) lookup(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	if len(r.Server) == 0 {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		return addrs, 0, err
+	}
+
+	server := r.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	var lastErr error
+	seen := make(map[string]bool)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		recs, t, err := queryAddrs(server, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(recs) > 0 && (ttl == 0 || t < ttl) {
+			ttl = t
+		}
+		for _, ip := range recs {
+			if !seen[ip.String()] {
+				seen[ip.String()] = true
+				addrs = append(addrs, net.IPAddr{IP: ip})
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("lookup %s on %s: no addresses", host, server)
+		}
+		return nil, 0, lastErr
+	}
+	return addrs, ttl, nil
+}
+
+////
+//  queryAddrs sends an A or AAAA query for host to server (over UDP, then
+//  TCP if the reply is truncated) and returns the addresses in the answer
+//  with the shortest TTL of its records
+func queryAddrs(server, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	query, id, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, proto := range []string{"udp", "tcp"} {
+		resp, _, _, _, err := dnsExchange(nil, proto, server, query, id)
+		if err != nil {
+			return nil, 0, err
+		}
+		var p dnsmessage.Parser
+		h, err := p.Start(resp)
+		if err != nil {
+			return nil, 0, err
+		}
+		if h.Truncated && proto == "udp" {
+			continue
+		}
+		if h.RCode != dnsmessage.RCodeSuccess {
+			return nil, 0, fmt.Errorf("lookup %s on %s: %s", host, server, rcodeName(h.RCode))
+		}
+		if err := p.SkipAllQuestions(); err != nil {
+			return nil, 0, err
+		}
+		answers, err := p.AllAnswers()
+		if err != nil {
+			return nil, 0, err
+		}
+		var ips []net.IP
+		var ttl time.Duration
+		for _, a := range answers {
+			if t := time.Duration(a.Header.TTL) * time.Second; ttl == 0 || t < ttl {
+				ttl = t // includes any CNAMEs on the way
+			}
+			switch b := a.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(b.A[:]))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(b.AAAA[:]))
+			}
+		}
+		return ips, ttl, nil
+	}
+	return nil, 0, errors.New("truncated reply over TCP")
+}
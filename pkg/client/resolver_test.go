@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var mu sync.Mutex
+	queries := 0
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			queries++
+			mu.Unlock()
+			pc.WriteTo(fakeDNS(t, buf[:n], true), from)
+		}
+	}()
+	sent := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries
+	}
+
+	now := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	r := NewResolver(pc.LocalAddr().String())
+	r.now = func() time.Time { return now }
+	lookup := func(host string) ([]net.IPAddr, error) {
+		return r.LookupIPAddr(context.Background(), host)
+	}
+
+	addrs, err := lookup("ok.test")
+	if err != nil || len(addrs) != 2 || sent() != 2 { // A and AAAA
+		t.Fatal("lookup got", addrs, err, "queries", sent())
+	}
+	now = now.Add(59 * time.Second) // the records' TTL is 60
+	if addrs, err = lookup("ok.test"); err != nil || len(addrs) != 2 || sent() != 2 {
+		t.Error("cached lookup got", addrs, err, "queries", sent())
+	}
+	now = now.Add(2 * time.Second)
+	if _, err = lookup("ok.test"); err != nil || sent() != 4 {
+		t.Error("expired lookup got", err, "queries", sent())
+	}
+
+	r.MaxTTL = 10 * time.Second
+	now = now.Add(61 * time.Second)
+	lookup("ok.test")
+	now = now.Add(11 * time.Second)
+	lookup("ok.test")
+	if sent() != 8 {
+		t.Error("MaxTTL: queries", sent())
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = lookup("no.test"); err == nil {
+			t.Error("want NXDOMAIN")
+		}
+	}
+	if addrs, err = lookup("10.1.2.3"); err != nil || len(addrs) != 1 || sent() != 10 {
+		t.Error("IP got", addrs, err, "queries", sent())
+	}
+
+	want := ResolverStats{Entries: 2, Hits: 1, NegHits: 1, Misses: 5, Errors: 1, Evictions: 3}
+	if stats := r.Stats(); stats != want {
+		t.Error("stats", stats, "want", want)
+	}
+
+	// with the resolver gone a refresh fails, but the stale answer is kept
+	pc.Close()
+	now = now.Add(time.Hour)
+	if _, err = lookup("ok.test"); err == nil {
+		t.Error("want a failed refresh")
+	}
+	if addrs, err = r.LookupStale(context.Background(), "ok.test"); err != nil || len(addrs) != 2 {
+		t.Error("stale got", addrs, err)
+	}
+	if addrs, err = r.LookupStale(context.Background(), "no.test"); err == nil {
+		t.Error("stale NXDOMAIN got", addrs)
+	}
+}
+
+func TestHTTPResolver(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	var mu sync.Mutex
+	queries := 0
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			queries++
+			mu.Unlock()
+			pc.WriteTo(fakeDNS(t, buf[:n], true), from)
+		}
+	}()
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer hs.Close()
+	_, port, _ := net.SplitHostPort(hs.Listener.Addr().String())
+
+	// HTTP pings ask -R's resolver, once per ping
+	saved := DefaultResolver
+	DefaultResolver = NewResolver(pc.LocalAddr().String())
+	defer func() { DefaultResolver = saved }()
+	for i := 1; i <= 2; i++ {
+		r := Fetch("http://local.test:"+port+"/", "")
+		mu.Lock()
+		n := queries
+		mu.Unlock()
+		if r == nil || r.RespCode != 200 || r.Remote != "127.0.0.1" || n < 2*i {
+			t.Fatal("ping", i, "got", r, "queries", n)
+		}
+	}
+}
@@ -32,6 +32,12 @@ func SentryInit() {
 ////
 //  LogSentry writes a message to the log (stderr) and also sends to sentry.io
 func LogSentry(l sentry.Level, format string, args ...interface{}) {
+	LogSentryTags(l, nil, format, args...)
+}
+
+////
+//  LogSentryTags is LogSentry with tags added to this event only
+func LogSentryTags(l sentry.Level, tags map[string]string, format string, args ...interface{}) {
 	e := errors.New(fmt.Sprintf(format, args...))
 	log.Println(e)
 	if sOn {
@@ -41,6 +47,26 @@ func LogSentry(l sentry.Level, format string, args ...interface{}) {
 		sentry.ConfigureScope(func(scope *sentry.Scope) {
 			scope.SetLevel(l)
 		})
-		sentry.CaptureException(e)
+		if len(tags) == 0 {
+			sentry.CaptureException(e)
+			return
+		}
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetTags(tags)
+			sentry.CaptureException(e)
+		})
+	}
+}
+
+////
+//  SetSentryTags tags every later Sentry event (e.g., with server labels)
+func SetSentryTags(tags map[string]string) {
+	if sOn {
+		smu.Lock()
+		defer smu.Unlock()
+
+		sentry.ConfigureScope(func(scope *sentry.Scope) {
+			scope.SetTags(tags)
+		})
 	}
 }
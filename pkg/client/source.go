@@ -0,0 +1,44 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+////
+//  ValidSource returns an error unless source is empty, an IP address, or
+//  the name of a network interface on this host (which needs Linux)
+func ValidSource(source string) error {
+	if len(source) == 0 || net.ParseIP(source) != nil {
+		return nil
+	}
+	if _, err := net.InterfaceByName(source); err != nil {
+		return errors.New("source " + source + " is not an IP address or interface: " + err.Error())
+	}
+	return canBindToDevice()
+}
+
+////
+//  dialer returns a dialer for network ("tcp" or "udp") with timeout,
+//  sending from o.Source if that is set: an IP address is bound as the
+//  local address, an interface name with SO_BINDTODEVICE
+func (o *Options) dialer(network string, timeout time.Duration) (*net.Dialer, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if o == nil || len(o.Source) == 0 {
+		return d, nil
+	}
+	if ip := net.ParseIP(o.Source); ip != nil {
+		if network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		return d, nil
+	}
+	if err := ValidSource(o.Source); err != nil {
+		return nil, err
+	}
+	bindToDevice(d, o.Source)
+	return d, nil
+}
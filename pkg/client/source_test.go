@@ -0,0 +1,35 @@
+package client
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchSource(t *testing.T) {
+	var from string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}))
+	defer hs.Close()
+
+	r := FetchWith(hs.URL+"/", "", &Options{Source: "127.0.0.1"})
+	if r == nil || r.RespCode != 200 || from != "127.0.0.1" {
+		t.Error("source IP got", r, "from", from)
+	}
+	if ValidSource("lo") == nil {
+		r = FetchWith(strings.Replace(hs.URL, "http", "tcp", 1), "", &Options{Source: "lo"})
+		if r == nil || r.RespCode != 0 {
+			t.Error("source interface got", r)
+		}
+	}
+
+	if ValidSource("no-such-if0") == nil {
+		t.Error("want error for unknown interface")
+	}
+	if r = FetchWith(hs.URL+"/", "", &Options{Source: "no-such-if0"}); r != nil {
+		t.Error("unknown interface got", r)
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"github.com/rafayopen/perftest/pkg/pt"
+
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// how long to wait for a banner from a tcp:// target
+	bannerTimeout = 5 * time.Second
+	maxBanner     = 512
+)
+
+////
+//  fetchTCP measures DNS lookup and TCP handshake time to a tcp://host:port
+//  target, then closes the connection.  With ?banner=true in the URL it
+//  first waits for the server to send something (SSH, SMTP and many other
+//  servers greet the client) and reports that as the Reply time.  RespCode
+//  is 0 on success, or HttpUnknown if the connection or banner read fails.
+func fetchTCP(u *url.URL, rmtIP string, o *Options) *FetchResult {
+	urlStr := u.String()
+	if len(u.Port()) == 0 {
+		log.Println("tcp target needs a port:", urlStr)
+		return nil
+	}
+	banner, _ := strconv.ParseBool(u.Query().Get("banner"))
+
+	status := HttpUnknown
+	location := LocUnknown
+	var bytes int64
+	var remoteIP string
+
+	tStart := time.Now().UTC()
+	tDnsLk, tTcpHs, tFirst := tStart, tStart, tStart
+
+	host, lookup, err := o.lookupHost(u.Hostname(), rmtIP)
+	tDnsLk = time.Now().UTC()
+	tTcpHs, tFirst = tDnsLk, tDnsLk
+	if err != nil {
+		log.Printf("tcp lookup %s: %v", u.Hostname(), err)
+	}
+
+	if len(host) > 0 {
+		dialer, err := o.dialer("tcp", 30*time.Second)
+		var conn net.Conn
+		if err == nil {
+			conn, err = dialer.Dial(o.network("tcp"), net.JoinHostPort(host, u.Port()))
+		}
+		tTcpHs = time.Now().UTC()
+		tFirst = tTcpHs
+		if err != nil {
+			log.Printf("tcp connect %s: %v", urlStr, err)
+		} else {
+			remoteIP = HostNoPort(conn.RemoteAddr().String())
+			status = 0
+			if banner {
+				buf := make([]byte, maxBanner)
+				conn.SetReadDeadline(time.Now().Add(bannerTimeout))
+				n, err := conn.Read(buf)
+				tFirst = time.Now().UTC()
+				bytes = int64(n)
+				if n == 0 {
+					log.Printf("tcp banner %s: %v", urlStr, err)
+					status = HttpUnknown
+				}
+			}
+			conn.Close()
+		}
+	}
+	tClose := time.Now().UTC()
+
+	p := pt.PingTimes{
+		Start:    tStart,
+		DnsLk:    tDnsLk.Sub(tStart),
+		TcpHs:    tTcpHs.Sub(tDnsLk),
+		Reply:    tFirst.Sub(tTcpHs), // banner wait, if any
+		Close:    tClose.Sub(tFirst),
+		Total:    tClose.Sub(tDnsLk),
+		DestUrl:  &urlStr,
+		Location: &location,
+		Remote:   remoteIP,
+		RespCode: status,
+		Size:     bytes,
+	}
+	return &FetchResult{PingTimes: p, Lookup: lookup}
+}
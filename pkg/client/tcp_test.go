@@ -0,0 +1,78 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFetchTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte("SSH-2.0-test\r\n"))
+			c.Close()
+		}
+	}()
+	addr := l.Addr().String()
+	port := addr[strings.LastIndex(addr, ":")+1:]
+
+	// a port nobody is listening on
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	cases := []struct {
+		url      string
+		ip       string
+		ok       bool
+		respCode int
+		size     int64
+	}{
+		{"tcp://" + addr, "", true, 0, 0},
+		{"tcp://" + addr + "?banner=true", "", true, 0, 14},
+		{"tcp://localhost:" + port, "", true, 0, 0},
+		{"tcp://somehost:" + port, "127.0.0.1", true, 0, 0}, // IP override
+		{"tcp://" + closedAddr, "", true, HttpUnknown, 0},
+		{"tcp://bad-hostname:22", "", true, HttpUnknown, 0},
+		{"tcp://127.0.0.1", "", false, 0, 0}, // no port
+	}
+
+	for n, c := range cases {
+		r := Fetch(c.url, c.ip)
+		if (r != nil) != c.ok {
+			t.Error("case", n, "got", r)
+			continue
+		}
+		if r == nil {
+			continue
+		}
+		if r.RespCode != c.respCode || r.Size != c.size {
+			t.Error("case", n, "resp", r.RespCode, "size", r.Size, "want", c.respCode, c.size)
+		}
+		if c.respCode == 0 && (r.Remote != "127.0.0.1" || r.TcpHs <= 0) {
+			t.Error("case", n, "remote", r.Remote, "TcpHs", r.TcpHs)
+		}
+	}
+
+	// the first lookup of a name is sent to the resolver, the next cached
+	saved := DefaultResolver
+	DefaultResolver = NewResolver("")
+	defer func() { DefaultResolver = saved }()
+	for n, want := range []string{LookupFresh, LookupCached} {
+		if r := Fetch("tcp://localhost:"+port, ""); r == nil || r.Lookup != want {
+			t.Error("lookup", n, "got", r, "want", want)
+		}
+	}
+	if r := Fetch("tcp://"+addr, ""); r == nil || r.Lookup != "" {
+		t.Error("IP address lookup got", r)
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+const (
+	// pingmesh peer paths used for bandwidth probes
+	DownloadPath = "/v1/ping"
+	UploadPath   = "/v1/sink"
+
+	MaxTransferSize = 1 << 30 // most bytes a pingmesh peer sends or sinks
+)
+
+////
+//  ValidTransferSize returns an error unless size is one a pingmesh peer
+//  will send or sink in full
+func ValidTransferSize(size int64) error {
+	if size < 1 || size > MaxTransferSize {
+		return fmt.Errorf("transfer size must be 1 to %d bytes", MaxTransferSize)
+	}
+	return nil
+}
+
+////
+//  Transfer is the result of one bulk download or upload
+type Transfer struct {
+	Bytes   int64         // payload bytes moved
+	Elapsed time.Duration // time spent moving them (see Download, Upload)
+}
+
+////
+//  Mbps returns the goodput of the transfer in megabits per second
+func (t *Transfer) Mbps() float64 {
+	if t.Elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Bytes*8) / t.Elapsed.Seconds() / 1e6
+}
+
+////
+//  transferClient returns a client for one transfer to host (on rmtIP, if
+//  set), which goes out like a ping with opts would: from its Source, over
+//  its Family and through its Proxy.  It also returns the Host header.
+func transferClient(scheme, host, rmtIP string, opts *Options) (*http.Client, string, error) {
+	host, peerAddr := MakePeerAddr(scheme, host, rmtIP)
+	dialer, err := opts.dialer("tcp", 30*time.Second)
+	if err != nil {
+		return nil, host, err
+	}
+	dialer.KeepAlive = 30 * time.Second
+	dialer.Resolver = DefaultResolver.NetResolver()
+	dial := dialFunc(dialer.DialContext)
+	if pu, err := parseProxy(opts.proxy()); err != nil {
+		return nil, host, fmt.Errorf("proxy %s: %v", RedactURL(opts.proxy()), err)
+	} else if pu != nil {
+		dial = proxyDial(pu, dialer, new(ProxyStats))
+	}
+	tr := &http.Transport{
+		DisableCompression: true, // measure the bytes on the wire
+		DisableKeepAlives:  true, // one request per client, leave nothing idle
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, opts.network(network), peerAddr)
+		},
+	}
+	return &http.Client{Transport: tr, Timeout: 5 * time.Minute}, host, nil
+}
+
+////
+//  Download fetches size bytes of random padding from the pingmesh peer at
+//  base (scheme://host[:port]) and times the transfer from the first to the
+//  last byte, so connection setup and server think time are excluded.  It
+//  gives up when ctx is done.  The connection is made as for a ping with
+//  opts (see transferClient), which may be nil.
+func Download(ctx context.Context, base, rmtIP string, size int64, opts *Options) (*Transfer, error) {
+	u := ParseURL(base)
+	if u == nil {
+		return nil, errors.New("Download: bad URL " + base)
+	}
+	if err := ValidTransferSize(size); err != nil {
+		return nil, errors.New("Download: " + err.Error())
+	}
+	client, host, err := transferClient(u.Scheme, u.Host, rmtIP, opts)
+	if err != nil {
+		return nil, err
+	}
+	urlStr := fmt.Sprintf("%s://%s%s?random=true&size=%d", u.Scheme, u.Host, DownloadPath, size)
+
+	req, err := http.NewRequest(http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	var tFirst time.Time
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() { tFirst = time.Now() },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	tLast := time.Now()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Download: HTTP status %d", resp.StatusCode)
+	}
+	if n < size {
+		return nil, fmt.Errorf("Download: got %d of %d bytes", n, size)
+	}
+	return &Transfer{Bytes: n, Elapsed: tLast.Sub(tFirst)}, nil
+}
+
+////
+//  Upload POSTs size random bytes to the pingmesh peer's sink at base and
+//  times the transfer from when the connection is ready until the peer's
+//  response (sent after it has read the whole body) arrives.  It gives up
+//  when ctx is done.  The connection is made as for a ping with opts (see
+//  transferClient), which may be nil.
+func Upload(ctx context.Context, base, rmtIP string, size int64, opts *Options) (*Transfer, error) {
+	u := ParseURL(base)
+	if u == nil {
+		return nil, errors.New("Upload: bad URL " + base)
+	}
+	if err := ValidTransferSize(size); err != nil {
+		return nil, errors.New("Upload: " + err.Error())
+	}
+	client, host, err := transferClient(u.Scheme, u.Host, rmtIP, opts)
+	if err != nil {
+		return nil, err
+	}
+	urlStr := u.Scheme + "://" + u.Host + UploadPath
+
+	body := io.LimitReader(rand.Reader, size)
+	req, err := http.NewRequest(http.MethodPost, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	var tConnd, tFirst time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn:              func(_ httptrace.GotConnInfo) { tConnd = time.Now() },
+		GotFirstResponseByte: func() { tFirst = time.Now() },
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Upload: HTTP status %d", resp.StatusCode)
+	}
+	return &Transfer{Bytes: size, Elapsed: tFirst.Sub(tConnd)}, nil
+}
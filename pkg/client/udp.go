@@ -0,0 +1,260 @@
+package client
+
+import (
+	"github.com/rafayopen/perftest/pkg/pt"
+
+	"bytes"
+	"encoding/binary"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// UDPMagic starts every pingmesh UDP probe packet; the echo responder
+	// ignores anything else
+	UDPMagic = "PMSH"
+	// magic, sequence number, send time offset (nsec)
+	udpHeaderLen = len(UDPMagic) + 4 + 8
+
+	udpDefaultCount    = 10
+	udpDefaultInterval = 20 * time.Millisecond
+	udpDefaultSize     = 64
+	udpDefaultTimeout  = time.Second
+	udpMaxCount        = 10000
+	udpMaxSize         = 1400
+)
+
+////
+//  UDPStats summarizes one interval of udp:// probe packets
+type UDPStats struct {
+	Sent      int           // packets sent
+	Received  int           // distinct packets echoed back
+	LossPct   float64       // percent of packets not echoed
+	Reordered int           // packets that arrived after a later one
+	MinRtt    time.Duration // round trip times of the echoed packets
+	AvgRtt    time.Duration
+	MaxRtt    time.Duration
+	Jitter    time.Duration // RFC 3550 interarrival jitter of the round trips
+}
+
+////
+//  udpOptions come from the query string of a udp:// URL
+type udpOptions struct {
+	count    int           // count= packets to send
+	interval time.Duration // interval= between packets
+	size     int           // size= bytes per packet
+	timeout  time.Duration // timeout= to wait for echoes after the last send
+}
+
+func parseUDPOptions(qs url.Values) udpOptions {
+	o := udpOptions{udpDefaultCount, udpDefaultInterval, udpDefaultSize, udpDefaultTimeout}
+	if n, err := strconv.Atoi(qs.Get("count")); err == nil && n > 0 && n <= udpMaxCount {
+		o.count = n
+	}
+	if d, err := time.ParseDuration(qs.Get("interval")); err == nil && d >= 0 {
+		o.interval = d
+	}
+	if n, err := strconv.Atoi(qs.Get("size")); err == nil && n >= udpHeaderLen && n <= udpMaxSize {
+		o.size = n
+	}
+	if d, err := time.ParseDuration(qs.Get("timeout")); err == nil && d > 0 {
+		o.timeout = d
+	}
+	return o
+}
+
+////
+//  fetchUDP sends a burst of sequenced, timestamped packets to the pingmesh
+//  UDP echo responder at udp://host:port and measures what comes back.  The
+//  query string can set count=, interval= (a duration), size= (bytes) and
+//  timeout= (wait after the last send).  The average RTT is reported as
+//  TcpHs, so it is published like the TCP RTT of other probes.  RespCode is
+//  0 if any packet came back, else HttpUnknown.
+func fetchUDP(u *url.URL, rmtIP string, o *Options) *FetchResult {
+	urlStr := u.String()
+	if len(u.Port()) == 0 {
+		log.Println("udp target needs a port:", urlStr)
+		return nil
+	}
+	opts := parseUDPOptions(u.Query())
+
+	location := LocUnknown
+	status := HttpUnknown
+	var remoteIP string
+	var stats *UDPStats
+	var bytes int64
+
+	tStart := time.Now().UTC()
+	tDnsLk := tStart
+	host, lookup, err := o.lookupHost(u.Hostname(), rmtIP)
+	tDnsLk = time.Now().UTC()
+	if err != nil {
+		log.Printf("udp lookup %s: %v", u.Hostname(), err)
+	}
+
+	if len(host) > 0 {
+		dialer, err := o.dialer("udp", 0)
+		var conn net.Conn
+		if err == nil {
+			conn, err = dialer.Dial(o.network("udp"), net.JoinHostPort(host, u.Port()))
+		}
+		if err != nil {
+			log.Printf("udp dial %s: %v", urlStr, err)
+		} else {
+			remoteIP = HostNoPort(conn.RemoteAddr().String())
+			stats, bytes = udpBurst(conn, opts)
+			conn.Close()
+			if stats.Received > 0 {
+				status = 0
+			}
+		}
+	}
+	tClose := time.Now().UTC()
+
+	p := pt.PingTimes{
+		Start:    tStart,
+		DnsLk:    tDnsLk.Sub(tStart),
+		Close:    tClose.Sub(tDnsLk),
+		Total:    tClose.Sub(tDnsLk),
+		DestUrl:  &urlStr,
+		Location: &location,
+		Remote:   remoteIP,
+		RespCode: status,
+		Size:     bytes,
+	}
+	if stats != nil {
+		p.TcpHs = stats.AvgRtt
+	}
+	return &FetchResult{PingTimes: p, UDP: stats, Lookup: lookup}
+}
+
+////
+//  isClosed reports whether err is from using a closed connection (go 1.12
+//  has no net.ErrClosed to compare with)
+func isClosed(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
+
+////
+//  udpBurst sends the packets and collects the echoes on conn, returning
+//  the stats and number of bytes received.
+func udpBurst(conn net.Conn, opts udpOptions) (*UDPStats, int64) {
+	start := time.Now()
+	type arrival struct {
+		seq uint32
+		rtt time.Duration
+	}
+	arrivals := make(chan arrival, opts.count)
+	var bytes int64
+
+	// reader: runs until the deadline set after the last send, or until
+	// conn is closed.  Other errors, like the connection refused from one
+	// ICMP port unreachable, do not lose the echoes still to come.
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		buf := make([]byte, udpMaxSize)
+		for {
+			n, err := conn.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() || isClosed(err) {
+				return
+			} else if err != nil {
+				continue
+			}
+			now := time.Since(start)
+			if n < udpHeaderLen || !bytesHasMagic(buf) {
+				continue
+			}
+			bytes += int64(n)
+			seq := binary.BigEndian.Uint32(buf[len(UDPMagic):])
+			sent := time.Duration(binary.BigEndian.Uint64(buf[len(UDPMagic)+4:]))
+			select {
+			case arrivals <- arrival{seq, now - sent}:
+			default: // more echoes than sent: duplicates, ignore
+			}
+		}
+	}()
+
+	pkt := make([]byte, opts.size)
+	copy(pkt, UDPMagic)
+	for seq := 0; seq < opts.count; seq++ {
+		if seq > 0 && opts.interval > 0 {
+			time.Sleep(opts.interval)
+		}
+		binary.BigEndian.PutUint32(pkt[len(UDPMagic):], uint32(seq))
+		binary.BigEndian.PutUint64(pkt[len(UDPMagic)+4:], uint64(time.Since(start)))
+		if _, err := conn.Write(pkt); err != nil {
+			log.Println("udp send:", err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(opts.timeout))
+	<-readDone
+	close(arrivals)
+
+	stats := &UDPStats{Sent: opts.count}
+	seen := make(map[uint32]bool)
+	var maxSeq uint32
+	var total, prevRtt time.Duration
+	var jitter float64
+	for a := range arrivals {
+		if int(a.seq) >= opts.count || seen[a.seq] {
+			continue
+		}
+		seen[a.seq] = true
+		if stats.Received > 0 {
+			if a.seq < maxSeq {
+				stats.Reordered++
+			}
+			// RFC 3550 section 6.4.1: J += (|D(i-1,i)| - J) / 16
+			d := float64(a.rtt - prevRtt)
+			if d < 0 {
+				d = -d
+			}
+			jitter += (d - jitter) / 16
+		}
+		if a.seq > maxSeq {
+			maxSeq = a.seq
+		}
+		if stats.Received == 0 || a.rtt < stats.MinRtt {
+			stats.MinRtt = a.rtt
+		}
+		if a.rtt > stats.MaxRtt {
+			stats.MaxRtt = a.rtt
+		}
+		prevRtt = a.rtt
+		total += a.rtt
+		stats.Received++
+	}
+	if stats.Received > 0 {
+		stats.AvgRtt = total / time.Duration(stats.Received)
+	}
+	stats.Jitter = time.Duration(jitter)
+	stats.LossPct = 100 * float64(stats.Sent-stats.Received) / float64(stats.Sent)
+	return stats, bytes
+}
+
+func bytesHasMagic(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(UDPMagic))
+}
+
+////
+//  ServeUDPEcho echoes pingmesh probe packets received on conn back to
+//  their sender until conn is closed.  Other packets are ignored, so the
+//  responder can not be used to reflect arbitrary traffic.
+func ServeUDPEcho(conn net.PacketConn) error {
+	buf := make([]byte, udpMaxSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n < udpHeaderLen || !bytesHasMagic(buf[:n]) {
+			continue
+		}
+		conn.WriteTo(buf[:n], addr)
+	}
+}
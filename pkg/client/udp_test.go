@@ -0,0 +1,113 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// dropEvery echoes like ServeUDPEcho but drops every nth packet
+func dropEvery(conn net.PacketConn, n int) {
+	buf := make([]byte, udpMaxSize)
+	for i := 1; ; i++ {
+		m, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if i%n != 0 {
+			conn.WriteTo(buf[:m], addr)
+		}
+	}
+}
+
+// blipEcho echoes the first packet on conn, then closes it for a moment, so
+// the next packets get ICMP port unreachable, and echoes on the same
+// address again
+func blipEcho(conn net.PacketConn, ready chan<- struct{}) {
+	buf := make([]byte, udpMaxSize)
+	m, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+	conn.WriteTo(buf[:m], addr)
+	local := conn.LocalAddr().String()
+	conn.Close()
+	time.Sleep(5 * time.Millisecond)
+	if conn, err = net.ListenPacket("udp", local); err != nil {
+		close(ready)
+		return
+	}
+	defer conn.Close()
+	close(ready)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	ServeUDPEcho(conn)
+}
+
+func TestFetchUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go ServeUDPEcho(echo)
+
+	lossy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lossy.Close()
+	go dropEvery(lossy, 4)
+
+	// a port nobody is listening on
+	closed, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	q := "?count=20&interval=1ms&timeout=200ms"
+	cases := []struct {
+		url      string
+		respCode int
+		received int
+	}{
+		{"udp://" + echo.LocalAddr().String() + q, 0, 20},
+		{"udp://" + echo.LocalAddr().String() + q + "&size=200", 0, 20},
+		{"udp://" + lossy.LocalAddr().String() + q, 0, 15},
+		{"udp://" + closedAddr + q, HttpUnknown, 0},
+	}
+
+	for n, c := range cases {
+		r := Fetch(c.url, "")
+		if r == nil || r.UDP == nil {
+			t.Error("case", n, "got", r)
+			continue
+		}
+		s := r.UDP
+		if r.RespCode != c.respCode || s.Sent != 20 || s.Received != c.received {
+			t.Errorf("case %d: resp %d sent %d received %d, want %d 20 %d",
+				n, r.RespCode, s.Sent, s.Received, c.respCode, c.received)
+		}
+		if want := 100 * float64(20-c.received) / 20; s.LossPct != want {
+			t.Error("case", n, "loss", s.LossPct, "want", want)
+		}
+		if s.Received > 0 && (s.MinRtt <= 0 || s.MinRtt > s.AvgRtt || s.AvgRtt > s.MaxRtt || r.TcpHs != s.AvgRtt) {
+			t.Error("case", n, "rtt", s.MinRtt, s.AvgRtt, s.MaxRtt, r.TcpHs)
+		}
+	}
+
+	// a brief blip loses only the echoes sent during it
+	blip, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := make(chan struct{})
+	go blipEcho(blip, ready)
+	r := Fetch("udp://"+blip.LocalAddr().String()+"?count=20&interval=2ms&timeout=200ms", "")
+	<-ready
+	if r == nil || r.UDP == nil || r.UDP.Received < 10 || r.UDP.Received == 20 {
+		t.Error("blip got", r)
+	}
+
+	if r := Fetch("udp://127.0.0.1", ""); r != nil {
+		t.Error("no port: got", r)
+	}
+}
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"github.com/rafayopen/perftest/pkg/pt"
+
+	"golang.org/x/net/websocket"
+
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	wsTimeout = 30 * time.Second
+	wsOrigin  = "http://pingmesh/"
+)
+
+////
+//  WSStats describes one ws:// probe sample
+type WSStats struct {
+	Rtt        time.Duration // message round trip on the open connection
+	NewConn    bool          `json:",omitempty"` // this sample opened a connection
+	Connect    time.Duration `json:",omitempty"` // TCP handshake, if NewConn
+	Upgrade    time.Duration `json:",omitempty"` // HTTP upgrade request to 101 response, if NewConn
+	Connects   int           // connections opened so far, including the first
+	Reconnects int           // connections opened to replace a lost one
+}
+
+////
+//  WSSession holds a WebSocket connection open between ws:// or wss:// probe
+//  samples.  Each Fetch sends one message and times the echo; the
+//  connection is made on the first Fetch and again whenever it is lost.
+type WSSession struct {
+	url        *url.URL
+	mu         sync.Mutex
+	conn       *websocket.Conn
+	seq        int
+	connects   int
+	reconnects int
+}
+
+////
+//  NewWSSession returns a session for rawurl (ws://host[:port]/path), or nil
+//  if it does not parse.  No connection is made until Fetch.
+func NewWSSession(rawurl string) *WSSession {
+	u := ParseURL(rawurl)
+	if u == nil || (u.Scheme != "ws" && u.Scheme != "wss") {
+		return nil
+	}
+	return &WSSession{url: u}
+}
+
+////
+//  Close closes the session's connection, if any
+func (s *WSSession) Close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+////
+//  Fetch sends a message on the session's connection, connecting first if
+//  needed (to rmtIP, if set), and times the echo.  A reused connection that
+//  fails is replaced at once and counted as a reconnect.  The message round
+//  trip is reported as TcpHs; on a sample that connects, DnsLk and TlsHs
+//  are the usual lookup and handshake and Reply is the HTTP upgrade time.
+//  RespCode is 0 if the echo came back, else HttpUnknown.
+func (s *WSSession) Fetch(rmtIP string) *FetchResult {
+	return s.FetchWith(rmtIP, nil)
+}
+
+////
+//  FetchWith is Fetch, connecting over the address family in opts (either
+//  if nil)
+func (s *WSSession) FetchWith(rmtIP string, opts *Options) *FetchResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	urlStr := s.url.String()
+	location := LocUnknown
+	status := HttpUnknown
+	var remoteIP string
+	var size int64
+	var stats *WSStats
+	var dnsLk, tlsHs, upgrade time.Duration
+	var lookup string // set when a sample connects
+
+	tStart := time.Now().UTC()
+	for try := 0; try < 2; try++ {
+		st := &WSStats{}
+		if s.conn == nil {
+			if s.connects > 0 {
+				s.reconnects++
+			}
+			s.connects++
+			var err error
+			var connect time.Duration
+			s.conn, lookup, dnsLk, connect, tlsHs, upgrade, err = s.dial(rmtIP, opts)
+			if err != nil {
+				log.Printf("ws connect %s: %v", urlStr, err)
+				break
+			}
+			st.NewConn, st.Connect, st.Upgrade = true, connect, upgrade
+		}
+		remoteIP = HostNoPort(s.conn.RemoteAddr().String())
+
+		rtt, n, err := s.echo()
+		if err != nil {
+			log.Printf("ws echo %s: %v", urlStr, err)
+			s.conn.Close()
+			s.conn = nil
+			if st.NewConn {
+				break // a fresh connection failed, wait for the next sample
+			}
+			continue
+		}
+		st.Rtt = rtt
+		stats, size, status = st, n, 0
+		break
+	}
+	tClose := time.Now().UTC()
+
+	if stats == nil {
+		stats = &WSStats{}
+	}
+	stats.Connects, stats.Reconnects = s.connects, s.reconnects
+
+	p := pt.PingTimes{
+		Start:    tStart,
+		DnsLk:    dnsLk,
+		TcpHs:    stats.Rtt,
+		TlsHs:    tlsHs,
+		Reply:    upgrade,
+		Total:    tClose.Sub(tStart) - dnsLk,
+		DestUrl:  &urlStr,
+		Location: &location,
+		Remote:   remoteIP,
+		RespCode: status,
+		Size:     size,
+	}
+	return &FetchResult{PingTimes: p, WS: stats, Lookup: lookup}
+}
+
+////
+//  dial makes the connection, returning it, how the name was looked up,
+//  and the DNS, TCP, TLS and upgrade times
+func (s *WSSession) dial(rmtIP string, o *Options) (conn *websocket.Conn, lookup string, dnsLk, connect, tlsHs, upgrade time.Duration, err error) {
+	port := s.url.Port()
+	if len(port) == 0 {
+		port = "80"
+		if s.url.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	t0 := time.Now()
+	host, lookup, err := o.lookupHost(s.url.Hostname(), rmtIP)
+	dnsLk = time.Since(t0)
+	if err != nil {
+		return nil, lookup, dnsLk, 0, 0, 0, fmt.Errorf("lookup %s: %v", s.url.Hostname(), err)
+	}
+
+	t1 := time.Now()
+	dialer, err := o.dialer("tcp", wsTimeout)
+	var nc net.Conn
+	if err == nil {
+		nc, err = dialer.Dial(o.network("tcp"), net.JoinHostPort(host, port))
+	}
+	connect = time.Since(t1)
+	if err != nil {
+		return nil, lookup, dnsLk, connect, 0, 0, err
+	}
+	nc.SetDeadline(time.Now().Add(wsTimeout))
+	if s.url.Scheme == "wss" {
+		t2 := time.Now()
+		tc := tls.Client(nc, &tls.Config{
+			ServerName:         s.url.Hostname(),
+			InsecureSkipVerify: true, // Warning: skips CA checks, but ping doesn't care
+		})
+		err = tc.Handshake()
+		tlsHs = time.Since(t2)
+		if err != nil {
+			nc.Close()
+			return nil, lookup, dnsLk, connect, tlsHs, 0, err
+		}
+		nc = tc
+	}
+
+	config, err := websocket.NewConfig(s.url.String(), wsOrigin)
+	if err != nil {
+		nc.Close()
+		return nil, lookup, dnsLk, connect, tlsHs, 0, err
+	}
+	t3 := time.Now()
+	conn, err = websocket.NewClient(config, nc)
+	upgrade = time.Since(t3)
+	if err != nil {
+		nc.Close()
+		return nil, lookup, dnsLk, connect, tlsHs, upgrade, err
+	}
+	nc.SetDeadline(time.Time{})
+	return conn, lookup, dnsLk, connect, tlsHs, upgrade, nil
+}
+
+////
+//  echo sends a numbered message and waits for it to come back, skipping
+//  any late echoes of earlier messages
+func (s *WSSession) echo() (time.Duration, int64, error) {
+	s.seq++
+	msg := fmt.Sprintf("pingmesh %d", s.seq)
+	s.conn.SetDeadline(time.Now().Add(wsTimeout))
+	defer s.conn.SetDeadline(time.Time{})
+
+	t0 := time.Now()
+	if err := websocket.Message.Send(s.conn, msg); err != nil {
+		return 0, 0, err
+	}
+	for {
+		var reply string
+		if err := websocket.Message.Receive(s.conn, &reply); err != nil {
+			return 0, 0, err
+		}
+		if reply == msg {
+			return time.Since(t0), int64(len(reply)), nil
+		}
+	}
+}
+
+////
+//  ServeWSEcho echoes each message received on conn until it is closed
+func ServeWSEcho(conn *websocket.Conn) {
+	defer conn.Close()
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			return
+		}
+		if err := websocket.Message.Send(conn, msg); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"golang.org/x/net/websocket"
+
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWSSession(t *testing.T) {
+	// echo one message per connection, then hang up
+	var from string
+	ts := httptest.NewServer(websocket.Server{Handler: func(c *websocket.Conn) {
+		from, _, _ = net.SplitHostPort(c.Request().RemoteAddr)
+		var msg string
+		if websocket.Message.Receive(c, &msg) == nil {
+			websocket.Message.Send(c, msg)
+		}
+		c.Close()
+	}})
+	defer ts.Close()
+
+	s := NewWSSession(strings.Replace(ts.URL, "http", "ws", 1) + "/v1/ws")
+	defer s.Close()
+	for i := 1; i <= 3; i++ {
+		r := s.Fetch("")
+		if r == nil || r.WS == nil {
+			t.Fatal("sample", i, "got", r)
+		}
+		ws := r.WS
+		// the first sample connects, later ones find the connection gone
+		if r.RespCode != 0 || !ws.NewConn || ws.Connects != i || ws.Reconnects != i-1 {
+			t.Errorf("sample %d: resp %d stats %+v", i, r.RespCode, *ws)
+		}
+		if ws.Rtt <= 0 || ws.Upgrade <= 0 || r.TcpHs != ws.Rtt || r.Reply != ws.Upgrade {
+			t.Errorf("sample %d: times %+v", i, *ws)
+		}
+	}
+
+	// the connection goes out from the source
+	src := NewWSSession(strings.Replace(ts.URL, "http", "ws", 1) + "/v1/ws")
+	defer src.Close()
+	if r := src.FetchWith("", &Options{Source: "127.0.0.2"}); r == nil || r.RespCode != 0 || from != "127.0.0.2" {
+		t.Error("source got", r, "from", from)
+	}
+	if r := src.FetchWith("", &Options{Source: "no-such-if0"}); r == nil || r.RespCode == 0 {
+		t.Error("unknown interface got", r)
+	}
+
+	if NewWSSession("http://example.com/") != nil {
+		t.Error("want nil session for http URL")
+	}
+}
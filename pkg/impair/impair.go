@@ -0,0 +1,433 @@
+// impair adds configurable network impairments in front of a server, so a
+// test mesh on one box produces latency distributions that look like a WAN.
+//
+// Impairments are applied in user space on the accepted connection: the
+// bytes from the client and the bytes to the client are each delayed once,
+// by the configured latency plus jitter, through a timestamped queue (so
+// the added latency does not grow with the number of reads and writes),
+// writes are paced to the bandwidth cap, and a fraction of connections is
+// dropped right after they are accepted.  The kernel completes the TCP
+// handshake before we see the connection, so the added delay shows up in
+// Reply (first byte) and Total, not in TcpHs.
+package impair
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+////
+//  Config holds the impairments to apply.  The zero value passes traffic
+//  through unchanged.
+type Config struct {
+	Latency   time.Duration // one-way delay added in each direction
+	Jitter    time.Duration // uniform random +/- variation on Latency
+	Loss      float64       // fraction (0..1) of connections dropped on accept
+	Bandwidth int64         // bytes per second cap per connection, 0 is unlimited
+	ErrorRate float64       // fraction (0..1) of HTTP requests answered with ErrorCode
+	ErrorCode int           // HTTP status for injected errors (default 503)
+	Seed      int64         // random seed, the same seed gives the same sequence
+}
+
+////
+//  Impairment applies a Config.  It is safe for concurrent use.
+type Impairment struct {
+	cfg Config
+	mu  sync.Mutex // protects rnd
+	rnd *rand.Rand
+}
+
+func New(cfg Config) *Impairment {
+	if cfg.ErrorCode == 0 {
+		cfg.ErrorCode = http.StatusServiceUnavailable
+	}
+	return &Impairment{cfg: cfg, rnd: rand.New(rand.NewSource(cfg.Seed))}
+}
+
+func (im *Impairment) Config() Config {
+	return im.cfg
+}
+
+////
+//  Delay returns the next one-way delay: Latency +/- Jitter, never negative
+func (im *Impairment) Delay() time.Duration {
+	if im.cfg.Latency == 0 && im.cfg.Jitter == 0 {
+		return 0
+	}
+	im.mu.Lock()
+	f := im.rnd.Float64()
+	im.mu.Unlock()
+
+	d := im.cfg.Latency + time.Duration((2*f-1)*float64(im.cfg.Jitter))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+func (im *Impairment) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return im.rnd.Float64() < p
+}
+
+////
+//  Drop reports whether the next connection should be dropped
+func (im *Impairment) Drop() bool {
+	return im.chance(im.cfg.Loss)
+}
+
+////
+//  Fail reports whether the next HTTP request should get an error response
+func (im *Impairment) Fail() bool {
+	return im.chance(im.cfg.ErrorRate)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//  Connection impairments
+////////////////////////////////////////////////////////////////////////////////
+
+type listener struct {
+	net.Listener
+	im *Impairment
+}
+
+////
+//  NewListener wraps l so accepted connections are impaired by im.  Dropped
+//  connections are closed as soon as they are accepted.
+func NewListener(l net.Listener, im *Impairment) net.Listener {
+	return &listener{l, im}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.im.Drop() {
+			c.Close()
+			continue
+		}
+		return newConn(c, l.im), nil
+	}
+}
+
+const (
+	queueLen  = 64       // chunks queued in each direction
+	readChunk = 32 << 10 // largest chunk read from the client at once
+)
+
+var errClosed = errors.New("impair: use of closed connection")
+
+// timeoutError is returned by a Read past its deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "impair: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+////
+//  chunk is data in a delay queue, to be passed on at due
+type chunk struct {
+	b   []byte
+	due time.Time
+}
+
+////
+//  conn delays each direction once: readLoop stamps the client's bytes as
+//  they arrive and Read hands them out when due, while Write stamps the
+//  bytes to the client and writeLoop sends them when due.  Read deadlines
+//  are kept here, since readLoop reads the client without one.
+type conn struct {
+	net.Conn
+	im *Impairment
+
+	in        chan chunk
+	head      *chunk // chunk being read
+	rerr      error  // why readLoop stopped, set before in is closed
+	lastIn    time.Time
+	rmu       sync.Mutex // protects rdeadline and rwake
+	rdeadline time.Time
+	rwake     chan struct{} // closed when the read deadline changes
+	out       chan chunk
+	wmu       sync.Mutex // protects lastOut and werr
+	lastOut   time.Time
+	werr      error
+	wdone     chan struct{} // closed when writeLoop stops
+	closing   chan struct{}
+	once      sync.Once
+	cerr      error
+}
+
+func newConn(c net.Conn, im *Impairment) *conn {
+	ic := &conn{
+		Conn:    c,
+		im:      im,
+		in:      make(chan chunk, queueLen),
+		rwake:   make(chan struct{}),
+		out:     make(chan chunk, queueLen),
+		wdone:   make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go ic.readLoop()
+	go ic.writeLoop()
+	return ic
+}
+
+////
+//  due returns when data queued now should be passed on, never before the
+//  data queued ahead of it (*last), so jitter does not reorder the stream
+func (c *conn) due(last *time.Time) time.Time {
+	due := time.Now().Add(c.im.Delay())
+	if due.Before(*last) {
+		due = *last
+	}
+	*last = due
+	return due
+}
+
+func (c *conn) readLoop() {
+	for {
+		b := make([]byte, readChunk)
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			select {
+			case c.in <- chunk{b: b[:n], due: c.due(&c.lastIn)}:
+			case <-c.closing:
+				return
+			}
+		}
+		if err != nil {
+			c.rerr = err
+			close(c.in)
+			return
+		}
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	for {
+		if n, err, retry := c.read(b); !retry {
+			return n, err
+		}
+	}
+}
+
+////
+//  read waits for the next due bytes until the read deadline, and asks to
+//  be retried if the deadline changes while it waits
+func (c *conn) read(b []byte) (n int, err error, retry bool) {
+	c.rmu.Lock()
+	deadline, wake := c.rdeadline, c.rwake
+	c.rmu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, timeoutError{}, false
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	if c.head == nil {
+		select {
+		case ch, ok := <-c.in:
+			if !ok {
+				return 0, c.rerr, false
+			}
+			c.head = &ch
+		case <-timeout:
+			return 0, timeoutError{}, false
+		case <-wake:
+			return 0, nil, true
+		case <-c.closing:
+			return 0, errClosed, false
+		}
+	}
+
+	if wait := time.Until(c.head.due); wait > 0 {
+		t := time.NewTimer(wait)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-timeout:
+			return 0, timeoutError{}, false
+		case <-wake:
+			return 0, nil, true
+		case <-c.closing:
+			return 0, errClosed, false
+		}
+	}
+
+	n = copy(b, c.head.b)
+	if c.head.b = c.head.b[n:]; len(c.head.b) == 0 {
+		c.head = nil
+	}
+	return n, nil, false
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	c.rdeadline = t
+	close(c.rwake)
+	c.rwake = make(chan struct{})
+	return nil
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	if c.werr != nil {
+		c.wmu.Unlock()
+		return 0, c.werr
+	}
+	ch := chunk{b: append([]byte(nil), b...), due: c.due(&c.lastOut)}
+	c.wmu.Unlock()
+
+	select {
+	case c.out <- ch:
+		return len(b), nil
+	case <-c.wdone:
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		return 0, c.werr
+	case <-c.closing:
+		return 0, errClosed
+	}
+}
+
+////
+//  writeLoop sends the queued writes when due, until the connection is
+//  closed and the queue is empty
+func (c *conn) writeLoop() {
+	defer close(c.wdone)
+	for {
+		var ch chunk
+		select {
+		case ch = <-c.out:
+		case <-c.closing:
+			select {
+			case ch = <-c.out:
+			default:
+				return
+			}
+		}
+		time.Sleep(time.Until(ch.due))
+		if err := c.pace(ch.b); err != nil {
+			c.wmu.Lock()
+			c.werr = err
+			c.wmu.Unlock()
+			return
+		}
+	}
+}
+
+////
+//  pace writes b to the client at no more than the bandwidth cap
+func (c *conn) pace(b []byte) error {
+	bw := c.im.cfg.Bandwidth
+	if bw <= 0 {
+		_, err := c.Conn.Write(b)
+		return err
+	}
+
+	// pace the write in chunks of 1/10 second worth of bandwidth
+	size := int(bw / 10)
+	if size < 1 {
+		size = 1
+	}
+	written := 0
+	for written < len(b) {
+		end := written + size
+		if end > len(b) {
+			end = len(b)
+		}
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(int64(n) * int64(time.Second) / bw))
+	}
+	return nil
+}
+
+////
+//  Close sends what is still queued to the client, then closes the
+//  connection
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		close(c.closing)
+		<-c.wdone
+		c.cerr = c.Conn.Close()
+	})
+	return c.cerr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//  Proxies
+////////////////////////////////////////////////////////////////////////////////
+
+////
+//  Handler returns next wrapped so a fraction of requests get an error
+func Handler(next http.Handler, im *Impairment) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if im.Fail() {
+			http.Error(w, "impaired", im.cfg.ErrorCode)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+////
+//  ServeTCP accepts connections on l (which should come from NewListener)
+//  and copies bytes to and from target until l is closed.
+func ServeTCP(l net.Listener, target string) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go forward(c, target)
+	}
+}
+
+func forward(c net.Conn, target string) {
+	defer c.Close()
+	t, err := net.Dial("tcp", target)
+	if err != nil {
+		log.Println("impair: dial", target, err)
+		return
+	}
+	defer t.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(t, c)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(c, t)
+		done <- struct{}{}
+	}()
+	<-done // either side closing ends the session
+}
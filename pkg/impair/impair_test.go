@@ -0,0 +1,120 @@
+package impair
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	cfg := Config{Latency: 20 * time.Millisecond, Jitter: 5 * time.Millisecond, Seed: 42}
+	a, b := New(cfg), New(cfg)
+	for i := 0; i < 100; i++ {
+		da, db := a.Delay(), b.Delay()
+		if da != db {
+			t.Fatal("sample", i, "not repeatable:", da, db)
+		}
+		if da < 15*time.Millisecond || da > 25*time.Millisecond {
+			t.Error("sample", i, "delay", da, "out of range")
+		}
+	}
+	if d := New(Config{}).Delay(); d != 0 {
+		t.Error("zero config delay", d)
+	}
+}
+
+// startProxy runs an impaired HTTP proxy to target and returns its URL
+func startProxy(t *testing.T, target string, cfg Config) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(target)
+	im := New(cfg)
+	srv := &http.Server{Handler: Handler(httputil.NewSingleHostReverseProxy(u), im)}
+	go srv.Serve(NewListener(l, im))
+	return "http://" + l.Addr().String(), func() { srv.Close() }
+}
+
+func TestProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 10000))
+	}))
+	defer target.Close()
+
+	cases := []struct {
+		cfg     Config
+		status  int // 0 means connection failure expected
+		minTime time.Duration
+	}{
+		{Config{}, 200, 0},
+		{Config{Latency: 30 * time.Millisecond}, 200, 60 * time.Millisecond},
+		{Config{Bandwidth: 50000}, 200, 150 * time.Millisecond},
+		{Config{ErrorRate: 1, ErrorCode: 500}, 500, 0},
+		{Config{Loss: 1}, 0, 0},
+	}
+
+	for n, c := range cases {
+		proxy, stop := startProxy(t, target.URL, c.cfg)
+		start := time.Now()
+		resp, err := http.Get(proxy)
+		if c.status == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Error("case", n, "expected connection failure, got", resp.StatusCode)
+			}
+			stop()
+			continue
+		}
+		if err != nil {
+			t.Fatal("case", n, err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		elapsed := time.Since(start)
+		if resp.StatusCode != c.status {
+			t.Error("case", n, "status", resp.StatusCode, "want", c.status)
+		}
+		if elapsed < c.minTime {
+			t.Error("case", n, "took", elapsed, "want at least", c.minTime)
+		}
+		stop()
+	}
+}
+
+func TestLatencyOnce(t *testing.T) {
+	// the response goes out in many small writes, each would be delayed
+	// if latency were added per write
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 20; i++ {
+			w.Write(make([]byte, 100))
+			w.(http.Flusher).Flush()
+		}
+	})}
+	go srv.Serve(NewListener(l, New(Config{Latency: 40 * time.Millisecond})))
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Get("http://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	elapsed := time.Since(start)
+	if len(body) != 2000 {
+		t.Error("body", len(body))
+	}
+	if elapsed < 80*time.Millisecond || elapsed > 400*time.Millisecond {
+		t.Error("took", elapsed, "want about 80ms")
+	}
+}
@@ -0,0 +1,285 @@
+// meshtest runs a mesh of pingmesh servers inside one process for testing.
+//
+// Each node is a server.MeshServer behind an httptest.Server on loopback.
+// All nodes share one Clock, so the test decides when pings happen: every
+// call to Round lets each active pinger send exactly one request.
+package meshtest
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client" // LocUnknown
+	"github.com/rafayopen/pingmesh/pkg/server"
+
+	"github.com/rafayopen/perftest/pkg/pt" // Msec
+
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	// how long to wait for the mesh to settle before failing the test
+	settleTimeout = 10 * time.Second
+)
+
+////
+//  Node is one pingmesh server in the mesh
+type Node struct {
+	Name string             // location reported by this node (node0, node1, ...)
+	Srv  *server.MeshServer // the server instance
+	HTTP *httptest.Server   // serving Srv.Handler() on loopback
+	URL  string             // base URL, like http://127.0.0.1:port
+}
+
+////
+//  Mesh is a set of nodes sharing a controllable clock
+type Mesh struct {
+	Nodes []*Node
+	Clock *server.VirtualClock
+
+	t testing.TB
+}
+
+////
+//  New starts n pingmesh servers that do not yet know about each other.
+//  Peers use a delay of one (virtual) second and no ping limit.
+func New(t testing.TB, n int) *Mesh {
+	t.Helper()
+	m := &Mesh{Clock: server.NewVirtualClock(time.Now().UTC()), t: t}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("node%d", i)
+		srv := server.NewMeshServer(name, 0, 0, 1, 100, 0)
+		srv.SetClock(m.Clock)
+		hs := httptest.NewServer(srv.Handler())
+		m.Nodes = append(m.Nodes, &Node{Name: name, Srv: srv, HTTP: hs, URL: hs.URL})
+	}
+	return m
+}
+
+////
+//  PingUrl returns the /v1/ping URL of node i
+func (m *Mesh) PingUrl(i int) string {
+	return m.Nodes[i].URL + "/v1/ping"
+}
+
+////
+//  AddPeer makes node from ping node to, and waits for the new pinger.
+func (m *Mesh) AddPeer(from, to int) {
+	m.t.Helper()
+	if _, err := m.Nodes[from].Srv.AddPingTarget(m.PingUrl(to), "", client.LocUnknown); err != nil {
+		m.t.Fatalf("node%d AddPingTarget node%d: %v", from, to, err)
+	}
+	m.Settle()
+}
+
+////
+//  FullMesh makes every node ping every other node
+func (m *Mesh) FullMesh() {
+	m.t.Helper()
+	for i := range m.Nodes {
+		for j := range m.Nodes {
+			if i != j {
+				m.AddPeer(i, j)
+			}
+		}
+	}
+}
+
+////
+//  Get makes an API request to node i and returns the response body
+func (m *Mesh) Get(i int, path string) string {
+	m.t.Helper()
+	resp, err := http.Get(m.Nodes[i].URL + path)
+	if err != nil {
+		m.t.Fatalf("GET node%d %s: %v", i, path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		m.t.Fatalf("GET node%d %s: reading body: %v", i, path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		m.t.Fatalf("GET node%d %s: status %d: %s", i, path, resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+////
+//  Post sends a JSON API request to node i and returns the response body
+func (m *Mesh) Post(i int, path, body string) string {
+	m.t.Helper()
+	resp, err := http.Post(m.Nodes[i].URL+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		m.t.Fatalf("POST node%d %s: %v", i, path, err)
+	}
+	defer resp.Body.Close()
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		m.t.Fatalf("POST node%d %s: reading body: %v", i, path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		m.t.Fatalf("POST node%d %s: status %d: %s", i, path, resp.StatusCode, reply)
+	}
+	return string(reply)
+}
+
+////
+//  Peers fetches and decodes /v1/peers from node i
+func (m *Mesh) Peers(i int) *server.MeshServer {
+	m.t.Helper()
+	rm, err := server.FetchRemotePeer(m.Nodes[i].URL+"/v1/peers", "")
+	if err != nil {
+		m.t.Fatalf("node%d /v1/peers: %v", i, err)
+	}
+	return rm
+}
+
+////
+//  Round lets every active pinger send one request, then waits for all of
+//  them to finish and block on the clock again (or exit).
+func (m *Mesh) Round() {
+	m.t.Helper()
+	m.Clock.FireAll()
+	m.Settle()
+}
+
+////
+//  Settle waits until every active pinger in the mesh is waiting on the clock
+func (m *Mesh) Settle() {
+	m.t.Helper()
+	deadline := time.Now().Add(settleTimeout)
+	for time.Now().Before(deadline) {
+		if m.Clock.Waiting() == m.active() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.t.Fatalf("mesh did not settle: %d active pingers, %d waiting", m.active(), m.Clock.Waiting())
+}
+
+////
+//  WaitFor polls cond until it returns true, failing the test on timeout
+func (m *Mesh) WaitFor(what string, cond func() bool) {
+	m.t.Helper()
+	deadline := time.Now().Add(settleTimeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m.t.Fatalf("timed out waiting for %s", what)
+}
+
+func (m *Mesh) active() int {
+	n := 0
+	for _, node := range m.Nodes {
+		n += node.Srv.Sleepers()
+	}
+	return n
+}
+
+////
+//  Wait waits for the goroutines of node i to exit.  The clock keeps
+//  advancing meanwhile so a pinger can not be stranded on a timer.
+func (m *Mesh) Wait(i int) {
+	m.t.Helper()
+	done := make(chan struct{})
+	go func() {
+		m.Nodes[i].Srv.Wait()
+		close(done)
+	}()
+	deadline := time.After(settleTimeout)
+	for {
+		select {
+		case <-done:
+			return
+		case <-deadline:
+			m.t.Fatalf("node%d goroutines did not exit", i)
+		case <-time.After(10 * time.Millisecond):
+			m.Clock.FireAll()
+		}
+	}
+}
+
+////
+//  Close stops every pinger and server in the mesh
+func (m *Mesh) Close() {
+	m.t.Helper()
+	for i, node := range m.Nodes {
+		node.Srv.CloseDoneChan()
+		m.Wait(i)
+	}
+	for _, node := range m.Nodes {
+		node.HTTP.Close()
+	}
+}
+
+////
+//  Matrix holds the average TCP RTT (msec) from each node (row) to each
+//  other node (column), as reported in their /v1/peers.  Cells with no
+//  successful pings are NaN.
+type Matrix struct {
+	Names []string
+	Rtt   [][]float64
+}
+
+////
+//  Matrix builds the RTT matrix from every node's /v1/peers.  With label
+//  selectors (key:value or key, see server.Labels) it only has the nodes
+//  whose server labels match them all.
+func (m *Mesh) Matrix(selectors ...string) *Matrix {
+	m.t.Helper()
+	var nodes []int
+	for i, node := range m.Nodes {
+		if node.Srv.Labels.Match(selectors) {
+			nodes = append(nodes, i)
+		}
+	}
+	mx := &Matrix{Rtt: make([][]float64, len(nodes))}
+	index := make(map[string]int)
+	for row, i := range nodes {
+		mx.Names = append(mx.Names, m.Nodes[i].Name)
+		index[m.Nodes[i].Name] = row
+		mx.Rtt[row] = make([]float64, len(nodes))
+		for j := range mx.Rtt[row] {
+			mx.Rtt[row][j] = math.NaN()
+		}
+	}
+
+	for i, n := range nodes {
+		for _, p := range m.Peers(n).Peers {
+			j, found := index[p.Location]
+			if !found || p.Pings == 0 {
+				continue
+			}
+			mx.Rtt[i][j] = pt.Msec(p.PingTotals.TcpHs) / float64(p.Pings)
+		}
+	}
+	return mx
+}
+
+func (mx *Matrix) String() string {
+	var sb strings.Builder
+	sb.WriteString("from\\to")
+	for _, name := range mx.Names {
+		fmt.Fprintf(&sb, "\t%s", name)
+	}
+	sb.WriteString("\n")
+	for i, row := range mx.Rtt {
+		sb.WriteString(mx.Names[i])
+		for _, rtt := range row {
+			if math.IsNaN(rtt) {
+				sb.WriteString("\t-")
+			} else {
+				fmt.Fprintf(&sb, "\t%.03f", rtt)
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,658 @@
+package meshtest
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+	"github.com/rafayopen/pingmesh/pkg/server"
+
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFullMesh(t *testing.T) {
+	m := New(t, 3)
+	defer m.Close()
+
+	m.FullMesh()
+	rounds := 3
+	for r := 0; r < rounds; r++ {
+		m.Round()
+	}
+
+	for i := range m.Nodes {
+		rm := m.Peers(i)
+		if rm.SrvLoc != m.Nodes[i].Name {
+			t.Error("node", i, "SrvLoc", rm.SrvLoc, "want", m.Nodes[i].Name)
+		}
+		if len(rm.Peers) != len(m.Nodes)-1 {
+			t.Fatal("node", i, "has", len(rm.Peers), "peers, want", len(m.Nodes)-1)
+		}
+		for _, p := range rm.Peers {
+			if p.Pings != rounds || p.Fails != 0 {
+				t.Error("node", i, "peer", p.Url, "pings", p.Pings, "fails", p.Fails, "want", rounds, 0)
+			}
+			if p.Location == m.Nodes[i].Name || !strings.HasPrefix(p.Location, "node") {
+				t.Error("node", i, "peer", p.Url, "has location", p.Location)
+			}
+			if p.OneWay == nil || p.OneWay.Samples != rounds {
+				t.Error("node", i, "peer", p.Url, "one-way estimates", p.OneWay)
+			}
+		}
+	}
+
+	mx := m.Matrix()
+	for i, row := range mx.Rtt {
+		for j, rtt := range row {
+			if i == j && !math.IsNaN(rtt) {
+				t.Error("matrix", i, j, "should be empty, got", rtt)
+			}
+			if i != j && (math.IsNaN(rtt) || rtt <= 0) {
+				t.Error("matrix", i, j, "should have an RTT, got", rtt)
+			}
+		}
+	}
+	if testing.Verbose() {
+		t.Log("\n" + mx.String())
+	}
+}
+
+func TestAddPeerLimit(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+
+	m.Get(0, "/v1/addpeer?limit=2&url="+url.QueryEscape(m.PingUrl(1)))
+	m.Settle()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 1 || rm.Peers[0].Limit != 2 {
+		t.Fatal("want one peer with limit 2, got", rm.Peers)
+	}
+
+	// adding it again is refused
+	if body := m.Get(0, "/v1/addpeer?url="+url.QueryEscape(m.PingUrl(1))); !strings.Contains(body, "already in the peer list") {
+		t.Error("duplicate addpeer response:", body)
+	}
+
+	m.Round()
+	m.Round() // reaches limit, peer is deleted
+
+	rm = m.Peers(0)
+	if len(rm.Peers) != 0 || rm.NumActive != 0 || rm.NumDeleted != 1 {
+		t.Fatal("want peer deleted, got", len(rm.Peers), "peers", rm.NumActive, "active", rm.NumDeleted, "deleted")
+	}
+	if len(rm.DelPeers) != 1 || rm.DelPeers[0].Pings != 2 || rm.DelPeers[0].Location != "node1" {
+		t.Error("unexpected deleted peers:", rm.DelPeers)
+	}
+}
+
+func TestAddPeersPeers(t *testing.T) {
+	m := New(t, 3)
+	defer m.Close()
+
+	m.AddPeer(1, 2)
+	m.Round()
+
+	target := m.Nodes[1].URL + "/v1/peers?addpeers=true"
+	m.Get(0, "/v1/addpeer?url="+url.QueryEscape(target))
+	m.WaitFor("node0 to add node1's peers", func() bool {
+		return m.Nodes[0].Srv.ActivePeers() == 2
+	})
+	m.Settle()
+	m.Round()
+
+	rm := m.Peers(0)
+	found := make(map[string]bool)
+	for _, p := range rm.Peers {
+		found[p.Url] = true
+		if p.Pings != 1 {
+			t.Error("peer", p.Url, "has", p.Pings, "pings, want 1")
+		}
+	}
+	if !found[m.Nodes[1].URL+"/v1/peers"] || !found[m.PingUrl(2)] {
+		t.Error("node0 peers missing node1 or node2:", found)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+
+	m.FullMesh()
+	m.Round()
+
+	if body := m.Get(0, "/v1/quit"); !strings.Contains(body, m.PingUrl(1)) {
+		t.Error("quit response does not list peer:", body)
+	}
+	m.Wait(0)
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 0 || len(rm.DelPeers) != 1 {
+		t.Error("node0 after quit has", len(rm.Peers), "peers and", len(rm.DelPeers), "deleted")
+	}
+
+	// node1 is unaffected and can still ping node0
+	m.Round()
+	if rm := m.Peers(1); len(rm.Peers) != 1 || rm.Peers[0].Pings != 2 {
+		t.Error("node1 after quit:", rm.Peers)
+	}
+}
+
+func TestPingOptions(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+
+	size := 200000
+	bulk := m.PingUrl(1) + "?delay=20&random=true&size=" + strconv.Itoa(size) // sorted, as addpeer re-encodes it
+	m.Get(0, "/v1/addpeer?url="+url.QueryEscape(bulk))
+	m.Settle()
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 1 {
+		t.Fatal("want 1 peer, got", rm.Peers)
+	}
+	p := rm.Peers[0]
+	if p.Url != bulk || p.Pings != 1 {
+		t.Fatal("peer", p.Url, "pings", p.Pings)
+	}
+	if p.PingTotals.Size < int64(size) || p.PingTotals.Reply < 20*time.Millisecond {
+		t.Error("size", p.PingTotals.Size, "reply", p.PingTotals.Reply)
+	}
+	if p.Location != "node1" || p.OneWay == nil {
+		t.Error("location", p.Location, "one-way", p.OneWay)
+	}
+
+	// a forced error status counts as a failure
+	m.Get(1, "/v1/addpeer?url="+url.QueryEscape(m.PingUrl(0)+"?status=503"))
+	m.Settle()
+	m.Round()
+	if rm := m.Peers(1); len(rm.Peers) != 1 || rm.Peers[0].Fails != 1 {
+		t.Error("status=503 peer:", rm.Peers)
+	}
+
+	if resp, err := http.Get(m.PingUrl(0) + "?size=-1"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Error("bad size accepted:", resp, err)
+	}
+
+	// random padding is raw bytes after the pong, and does not compress
+	req, _ := http.NewRequest(http.MethodGet, m.PingUrl(1)+"?random=true&size="+strconv.Itoa(size), nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.Header.Get("Content-Type") != "application/octet-stream" || len(body) < size {
+		t.Fatal("random pad", resp.Header, len(body), err)
+	}
+	if pong := client.ParsePong(body); pong == nil || pong.SrvLoc != "node1" {
+		t.Error("pong before random pad", pong)
+	}
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(body[len(body)-size:])
+	zw.Close()
+	if zipped.Len() < size {
+		t.Error("random pad of", size, "bytes compressed to", zipped.Len())
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+
+	m.Get(0, "/v1/addpeer?bwdelay=30&bwsize=100000&url="+url.QueryEscape(m.PingUrl(1)))
+	m.Settle()
+	if n := m.Nodes[0].Srv.Sleepers(); n != 2 {
+		t.Fatal("want ping and bandwidth goroutines, got", n)
+	}
+	m.Round()
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 1 {
+		t.Fatal("want 1 peer, got", rm.Peers)
+	}
+	p := rm.Peers[0]
+	if p.Pings != 2 || p.Bw == nil || p.Bw.Probes != 2 || p.Bw.Fails != 0 {
+		t.Fatal("pings", p.Pings, "bandwidth", p.Bw)
+	}
+	if p.Bw.DownMbps <= 0 || p.Bw.UpMbps <= 0 || p.Bw.DownAvg <= 0 || p.Bw.UpAvg <= 0 {
+		t.Error("bandwidth rates", *p.Bw)
+	}
+
+	// a size over what the peer will send is refused, not requested
+	m.Get(1, "/v1/addpeer?bwdelay=30&bwsize="+strconv.Itoa(client.MaxTransferSize+1)+"&url="+url.QueryEscape(m.PingUrl(0)))
+	m.Settle()
+	if rm := m.Peers(1); len(rm.Peers) != 1 || rm.Peers[0].BwSize != 0 {
+		t.Error("oversize bwsize accepted:", rm.Peers)
+	}
+	base := strings.TrimSuffix(m.PingUrl(1), client.DownloadPath)
+	if _, err := client.Download(context.Background(), base, "", client.MaxTransferSize+1, nil); err == nil {
+		t.Error("oversize download requested")
+	}
+
+	// a transfer goes out like the peer's pings: from its source, over its
+	// family and through its proxy
+	for _, opts := range []*client.Options{
+		{Source: "no-such-if0"},
+		{Family: client.FamilyIPv6}, // node1 listens on IPv4 only
+		{Proxy: "http://127.0.0.1:1"},
+	} {
+		if _, err := client.Download(context.Background(), base, "", 1000, opts); err == nil {
+			t.Errorf("download with %+v", *opts)
+		}
+	}
+	if tr, err := client.Upload(context.Background(), base, "", 1000, &client.Options{Source: "127.0.0.1", Family: client.FamilyIPv4}); err != nil || tr.Bytes != 1000 {
+		t.Error("upload from 127.0.0.1 got", tr, err)
+	}
+
+	// a transfer gives up when its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.Upload(ctx, base, "", 100000, nil); err == nil {
+		t.Error("upload with a canceled context")
+	}
+}
+
+func TestUDPEcho(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+
+	addr, err := m.Nodes[1].Srv.StartUDPEcho("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Nodes[1].Srv.Shutdown()
+
+	target := "udp://" + addr.String() + "?count=5&interval=1ms&timeout=100ms"
+	m.Get(0, "/v1/addpeer?url="+url.QueryEscape(target))
+	m.Settle()
+	m.Round()
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 1 {
+		t.Fatal("want 1 peer, got", rm.Peers)
+	}
+	p := rm.Peers[0]
+	if p.Pings != 2 || p.UDP == nil || p.UDPSent != 10 || p.UDPRecv != 10 || p.UDP.LossPct != 0 {
+		t.Fatal("pings", p.Pings, "sent", p.UDPSent, "recv", p.UDPRecv, "latest", p.UDP)
+	}
+}
+
+func TestGRPC(t *testing.T) {
+	m := New(t, 4)
+	defer m.Close()
+
+	// one peer per host, so each target is on a different node
+	base := func(i int) string {
+		u, _ := url.Parse(m.PingUrl(i))
+		return "grpc://" + u.Host
+	}
+	targets := []string{
+		base(1) + "/pingmesh.v1.Mesh/Ping",
+		base(2) + "/pingmesh",
+		base(3) + "/other.Service",
+	}
+	for _, target := range targets {
+		m.Get(0, "/v1/addpeer?url="+url.QueryEscape(target))
+	}
+	m.Settle()
+	m.Round()
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != len(targets) {
+		t.Fatal("want", len(targets), "peers, got", rm.Peers)
+	}
+	for _, p := range rm.Peers {
+		if p.GRPC == nil {
+			t.Error(p.Url, "no gRPC stats")
+			continue
+		}
+		switch p.Url {
+		case targets[0]:
+			if p.Pings != 2 || p.GRPC.Code != 0 || p.Location != "node1" || p.OneWay == nil {
+				t.Error(p.Url, "pings", p.Pings, "location", p.Location, "stats", *p.GRPC)
+			}
+		case targets[1]:
+			if p.Pings != 2 || p.GRPC.Health != "SERVING" {
+				t.Error(p.Url, "pings", p.Pings, "stats", *p.GRPC)
+			}
+		case targets[2]:
+			if p.Fails != 2 || p.GRPC.Code != 5 {
+				t.Error(p.Url, "fails", p.Fails, "stats", *p.GRPC)
+			}
+		}
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+
+	u, _ := url.Parse(m.PingUrl(1))
+	target := "ws://" + u.Host + "/v1/ws"
+	m.Get(0, "/v1/addpeer?url="+url.QueryEscape(target))
+	m.Settle()
+	for i := 0; i < 3; i++ {
+		m.Round()
+	}
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 1 {
+		t.Fatal("want 1 peer, got", rm.Peers)
+	}
+	p := rm.Peers[0]
+	// one connection, held open across the samples
+	if p.Pings != 3 || p.WS == nil || p.WS.Connects != 1 || p.WS.NewConn || p.WS.Rtt <= 0 {
+		t.Fatal("pings", p.Pings, "stats", p.WS)
+	}
+}
+
+func TestProto(t *testing.T) {
+	m := New(t, 3)
+	defer m.Close()
+
+	m.Get(0, "/v1/addpeer?proto=h2c&url="+url.QueryEscape(m.PingUrl(1)))
+	m.Get(0, "/v1/addpeer?url="+url.QueryEscape(m.PingUrl(2)))
+	m.Settle()
+	m.Round()
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 2 {
+		t.Fatal("want 2 peers, got", rm.Peers)
+	}
+	for _, p := range rm.Peers {
+		want := "HTTP/1.1"
+		if p.Proto == "h2c" {
+			want = "HTTP/2.0"
+		}
+		// the JSON pong works over either
+		if ps := p.Protos[want]; ps == nil || ps.Pings != 2 || len(p.Protos) != 1 || p.OneWay == nil {
+			t.Error(p.Url, p.Proto, "protos", p.Protos)
+		}
+	}
+}
+
+func TestPostPeers(t *testing.T) {
+	m := New(t, 3)
+	defer m.Close()
+
+	specs := `[
+	  {"Url": "` + m.PingUrl(1) + `", "Limit": 2},
+	  {"Url": "` + m.Nodes[2].URL + `/v1/sink", "Method": "post", "Body": "hello",
+	   "Headers": {"Authorization": "Bearer xyzzy", "X-Probe": "yes"}},
+	  {"Url": "` + m.PingUrl(1) + `"},
+	  {"Url": "", "Delay": 5},
+	  {"Url": "http://proxied.example.com/", "Proxy": "ftp://u:p@proxy"}
+	]`
+	reply := m.Post(0, "/v1/peers", specs)
+	if strings.Count(reply, `"Error"`) != 3 || !strings.Contains(reply, "bad Proxy") || !strings.Contains(reply, "already present") {
+		t.Error("reply", reply)
+	}
+	m.Settle()
+	m.Round()
+
+	if peers := m.Get(0, "/v1/peers"); strings.Contains(peers, "xyzzy") || strings.Contains(peers, "hello") || !strings.Contains(peers, `"X-Probe": "yes"`) {
+		t.Error("credentials not redacted in", peers)
+	}
+	rm := m.Peers(0)
+	if len(rm.Peers) != 2 {
+		t.Fatal("want 2 peers, got", rm.Peers)
+	}
+	for _, p := range rm.Peers {
+		if p.Pings != 1 || p.Fails != 0 {
+			t.Error(p.Url, "pings", p.Pings, "fails", p.Fails)
+		}
+		if strings.HasSuffix(p.Url, "/v1/sink") && (p.Method != "POST" || p.PingTotals.Size == 0) {
+			t.Error(p.Url, "method", p.Method, "size", p.PingTotals.Size)
+		}
+		if strings.HasSuffix(p.Url, "/v1/ping") && p.Limit != 2 {
+			t.Error(p.Url, "limit", p.Limit)
+		}
+	}
+
+	// a negative delay would spin the ping loop, so the POST is refused
+	bad := `{"Url": "` + m.PingUrl(2) + `", "Delay": -1}`
+	resp, err := http.Post(m.Nodes[0].URL+"/v1/peers", "application/json", strings.NewReader(bad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("negative delay: status", resp.StatusCode)
+	}
+	if rm := m.Peers(0); len(rm.Peers) != 2 {
+		t.Error("want 2 peers, got", rm.Peers)
+	}
+}
+
+func TestExpect(t *testing.T) {
+	m := New(t, 4)
+	defer m.Close()
+
+	m.Get(0, "/v1/addpeer?expect_json=SrvLoc=node1&expect_header=Content-Type:json&url="+url.QueryEscape(m.PingUrl(1)))
+	m.Get(0, "/v1/addpeer?expect_body=Welcome+to+the+hotel&url="+url.QueryEscape(m.PingUrl(2)))
+	m.Get(0, "/v1/addpeer?expect_status=404&url="+url.QueryEscape(m.PingUrl(3)+"?status=404"))
+	m.Settle()
+	m.Round()
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 3 {
+		t.Fatal("want 3 peers, got", rm.Peers)
+	}
+	for _, p := range rm.Peers {
+		switch {
+		case strings.HasPrefix(p.Url, m.Nodes[2].URL):
+			// a 200 response without the expected content is a failure
+			if p.Pings != 0 || p.Fails != 2 || p.AssertFails != 2 || !strings.Contains(p.LastAssert, "Welcome") {
+				t.Error(p.Url, "pings", p.Pings, "fails", p.Fails, p.AssertFails, p.LastAssert)
+			}
+		default:
+			if p.Pings != 2 || p.Fails != 0 || p.Expect == nil {
+				t.Error(p.Url, "pings", p.Pings, "fails", p.Fails, p.LastAssert)
+			}
+		}
+	}
+}
+
+func TestSources(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+
+	if err := m.Nodes[0].Srv.SetSources([]string{"127.0.0.1", "lo"}); err != nil {
+		t.Skip("cannot bind to the loopback interface:", err)
+	}
+	m.AddPeer(0, 1)
+	if reply := m.Get(0, "/v1/addpeer?url="+url.QueryEscape(m.PingUrl(1))); !strings.Contains(reply, "already") {
+		t.Error("adding again got", reply)
+	}
+	m.Settle()
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 2 {
+		t.Fatal("want a peer per source, got", rm.Peers)
+	}
+	sources := map[string]bool{}
+	for _, p := range rm.Peers {
+		sources[p.Source] = true
+		if p.Pings != 1 || p.Fails != 0 {
+			t.Error("from", p.Source, "pings", p.Pings, "fails", p.Fails)
+		}
+	}
+	if !sources["127.0.0.1"] || !sources["lo"] {
+		t.Error("sources", sources)
+	}
+}
+
+func TestFamily(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+
+	// nodes listen on 127.0.0.1, so only the ipv4 peers get through, by
+	// HTTP or by a tcp:// probe of the name
+	m.Get(0, "/v1/addpeer?family=both&url="+url.QueryEscape(m.PingUrl(1)))
+	tcp := "tcp://" + strings.Replace(strings.TrimPrefix(m.Nodes[1].URL, "http://"), "127.0.0.1", "localhost", 1)
+	m.Get(0, "/v1/addpeer?family=both&url="+url.QueryEscape(tcp))
+	m.Settle()
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 4 {
+		t.Fatal("want a peer per target and family, got", rm.Peers)
+	}
+	for _, p := range rm.Peers {
+		switch {
+		case p.Family == "ipv4" && p.Pings == 1 && p.Fails == 0:
+		case p.Family == "ipv6" && p.Pings == 0 && p.Fails == 1:
+		default:
+			t.Error(p.Family, "pings", p.Pings, "fails", p.Fails)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	m := New(t, 3)
+	defer m.Close()
+	regions := []string{"us-west", "us-west", "eu-central"}
+	for i, node := range m.Nodes {
+		node.Srv.SetLabels(server.Labels{"region": regions[i]})
+	}
+	for i := range m.Nodes {
+		for j := range m.Nodes {
+			if i != j {
+				m.Get(i, "/v1/addpeer?label=region:"+regions[j]+"&label=provider:aws&url="+url.QueryEscape(m.PingUrl(j)))
+			}
+		}
+	}
+	m.Settle()
+	m.Round()
+
+	rm, err := server.FetchRemotePeer(m.Nodes[0].URL+"/v1/peers?label=region:eu-central,provider", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm.Labels["region"] != "us-west" || len(rm.Peers) != 1 || rm.Peers[0].Url != m.PingUrl(2) {
+		t.Error("labels", rm.Labels, "filtered peers", rm.Peers)
+	}
+	if rm := m.Peers(0); len(rm.Peers) != 2 || rm.Peers[0].Labels["provider"] != "aws" {
+		t.Error("unfiltered peers", rm.Peers)
+	}
+
+	mx := m.Matrix("region:us-west")
+	if len(mx.Names) != 2 || math.IsNaN(mx.Rtt[0][1]) || math.IsNaN(mx.Rtt[1][0]) {
+		t.Error("us-west matrix\n" + mx.String())
+	}
+}
+
+func TestGeo(t *testing.T) {
+	m := New(t, 2)
+	defer m.Close()
+	m.Nodes[0].Srv.SetGeo(&client.Geo{City: "San Francisco", Country: "US", Lat: 37.7749, Lon: -122.4194})
+	m.Nodes[1].Srv.SetGeo(&client.Geo{City: "New York", Country: "US", Lat: 40.7128, Lon: -74.0060})
+	m.AddPeer(0, 1)
+	m.Round()
+
+	rm := m.Peers(0)
+	if len(rm.Peers) != 1 || rm.Geo == nil || rm.Geo.City != "San Francisco" {
+		t.Fatal("server geo", rm.Geo, "peers", rm.Peers)
+	}
+	p := rm.Peers[0]
+	if p.Geo == nil || p.Geo.City != "New York" || math.Abs(p.DistanceKm-4129) > 5 || p.FloorMs < 40 || p.FloorMs > 41 {
+		t.Error("peer geo", p.Geo, "km", p.DistanceKm, "floor", p.FloorMs)
+	}
+	// loopback beats light in fiber across the continent
+	if p.AboveFloor >= 0 {
+		t.Error("above floor", p.AboveFloor)
+	}
+}
+
+func TestVerdicts(t *testing.T) {
+	m := New(t, 3)
+	defer m.Close()
+	m.AddPeer(0, 1)
+	m.AddPeer(1, 0)
+	// node2 answers both with errors, so both see it down, though they
+	// ping it on different URLs
+	m.Get(0, "/v1/addpeer?url="+url.QueryEscape(m.PingUrl(2)+"?status=503"))
+	m.Get(1, "/v1/addpeer?url="+url.QueryEscape(m.PingUrl(2)+"?status=500"))
+	node2 := "http://" + client.ParseURL(m.PingUrl(2)).Host
+	m.Settle()
+	// a node recomputes the verdicts it sends at most once per ping delay,
+	// so they can lag a round behind its pings
+	for r := 0; r < 6; r++ {
+		m.Round()
+	}
+
+	var v server.Verdicts
+	if err := json.Unmarshal([]byte(m.Get(0, "/v1/verdicts")), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Vantages) != 2 || len(v.Targets) != 3 {
+		t.Fatalf("verdicts %+v", v)
+	}
+	for _, tv := range v.Targets {
+		switch {
+		case tv.Url == node2:
+			if tv.Verdict != "down" || len(tv.Down) != 2 || tv.Quorum != 2 {
+				t.Errorf("node2 verdict %+v", *tv)
+			}
+		case tv.Verdict != "up" || len(tv.Up) != 1:
+			t.Errorf("verdict %+v", *tv)
+		}
+	}
+}
+
+func TestVerdictsSharedLocation(t *testing.T) {
+	m := New(t, 4)
+	defer m.Close()
+	// node0, node1 and node2 are in the same place, but are three vantage points
+	for i := 0; i < 3; i++ {
+		m.Nodes[i].Srv.SrvLoc = "shared"
+	}
+	m.AddPeer(0, 1)
+	m.AddPeer(0, 2)
+	// node1 sees node3 down, node2 sees it up
+	m.Get(1, "/v1/addpeer?url="+url.QueryEscape(m.PingUrl(3)+"?status=503"))
+	m.Get(2, "/v1/addpeer?url="+url.QueryEscape(m.PingUrl(3)))
+	m.Settle()
+	for r := 0; r < 7; r++ {
+		m.Round()
+	}
+
+	var v server.Verdicts
+	if err := json.Unmarshal([]byte(m.Get(0, "/v1/verdicts")), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Vantages) != 3 {
+		t.Fatalf("vantages %+v", v.Vantages)
+	}
+	node3 := "http://" + client.ParseURL(m.PingUrl(3)).Host
+	var found bool
+	for _, tv := range v.Targets {
+		if tv.Url == node3 {
+			found = true
+			if tv.Verdict != "partial" || len(tv.Up) != 1 || len(tv.Down) != 1 || tv.Quorum != 2 {
+				t.Errorf("node3 verdict %+v", *tv)
+			}
+		}
+	}
+	if !found {
+		t.Error("no verdict on node3:", v.Targets)
+	}
+}
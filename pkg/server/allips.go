@@ -0,0 +1,181 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"context"
+	"log"
+	"net"
+	"sort"
+)
+
+// defaultResolve is the default number of seconds between an all_ips
+// peer's DNS lookups
+const defaultResolve = 60
+
+////
+//  FanOut runs an all_ips peer.  Rather than pinging its Url itself, it
+//  looks up the hostname every Resolve seconds and keeps a child peer
+//  pinging each address, using the IP override so the Host header and TLS
+//  server name are unchanged.  A child whose address leaves DNS is stopped.
+//  FanOut returns, stopping its children, when the server is done, the peer
+//  is stopped, every child has finished, or the lookup fails Maxfail times
+//  in a row.  Children remove themselves from the peer list as they exit.
+func (p *peer) FanOut() {
+	defer close(p.stopped)
+	defer p.ms.Done()
+	defer p.ms.Delete(p)
+
+	children := make(map[string]*peer) // by IP address
+	defer func() {
+		for _, c := range children {
+			c.Stop()
+		}
+	}()
+
+	resolve := p.Resolve
+	if resolve <= 0 {
+		resolve = defaultResolve
+	}
+	failed := 0
+	for {
+		if p.ms.DoneChan() == nil {
+			return
+		}
+		if ips, err := p.lookupIPs(); err != nil {
+			failed++
+			func() {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				p.Fails++
+			}()
+			log.Println("all_ips lookup failure", failed, "of", p.Maxfail, "on", p.Url+":", err)
+			if failed >= p.Maxfail {
+				return
+			}
+		} else {
+			failed = 0
+			p.reconcile(children, ips)
+		}
+
+		if len(children) > 0 && allStopped(children) {
+			return // every child reached its limit or failed
+		}
+
+		select {
+		case <-p.ms.clock.After(p.ms.jitterPct(resolve, 1)):
+		case _, more := <-p.ms.DoneChan():
+			if !more {
+				return
+			}
+		}
+		if p.stopping() {
+			return
+		}
+	}
+}
+
+////
+//  lookupIPs returns the addresses of the peer's host, in its address
+//  family if that is set
+func (p *peer) lookupIPs() ([]string, error) {
+	addrs, err := p.ms.lookupIPAddr(client.HostNoPort(p.Host))
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, a := range addrs {
+		ip := a.IP.String()
+		if len(p.Family) == 0 || client.IPFamily(ip) == p.Family {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+////
+//  reconcile starts a child for each address in ips that has none, and
+//  stops the children of addresses no longer in ips.  A child that finished
+//  on its own is not restarted while its address remains.
+func (p *peer) reconcile(children map[string]*peer, ips []string) {
+	live := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		live[ip] = true
+		if children[ip] != nil {
+			continue
+		}
+		c, err := p.ms.addPingTarget(p.Url, ip, p.Location, []string{p.Source}, p.Family, p.childSetup)
+		if err != nil {
+			log.Println("all_ips", p.Url, "on", ip+":", err)
+			continue
+		}
+		if p.ms.Verbose() > 0 {
+			log.Println("all_ips", p.Url, "now pinging", ip)
+		}
+		children[ip] = c
+	}
+	for ip, c := range children {
+		if !live[ip] {
+			if p.ms.Verbose() > 0 {
+				log.Println("all_ips", p.Url, "retiring", ip, "(gone from DNS)")
+			}
+			c.Stop()
+			delete(children, ip)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.IPs = ips
+}
+
+////
+//  childSetup gives a child the parent's ping options
+func (p *peer) childSetup(c *peer) {
+	c.Limit, c.Delay, c.Maxfail = p.Limit, p.Delay, p.Maxfail
+	c.BwDelay, c.BwSize = p.BwDelay, p.BwSize
+	c.Proto, c.Method, c.Headers, c.Body = p.Proto, p.Method, p.Headers, p.Body
+	c.Expect, c.FollowRedirects, c.Proxy = p.Expect, p.FollowRedirects, p.Proxy
+	c.Labels, c.Geo = p.Labels, p.Geo
+	c.AnomalyFactor = p.AnomalyFactor
+	c.FromAllIPs = true
+}
+
+func allStopped(children map[string]*peer) bool {
+	for _, c := range children {
+		select {
+		case <-c.stopped:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+////
+//  Stop tells the peer's goroutine to return when it next wakes up.  (It
+//  does not cut the sleep short, which would leave a VirtualClock timer
+//  that no one is waiting for.)
+func (p *peer) Stop() {
+	p.stopOnce.Do(func() { close(p.quit) })
+}
+
+func (p *peer) stopping() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+////
+//  lookupIPAddr resolves host through the DNS cache (tests can replace the
+//  resolver with lookup)
+func (ms *meshSrv) lookupIPAddr(host string) ([]net.IPAddr, error) {
+	if ms.lookup != nil {
+		return ms.lookup(host)
+	}
+	return client.DefaultResolver.LookupIPAddr(context.Background(), host)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"github.com/getsentry/sentry-go"
+
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	anomalyWarmup = 10   // samples before anything is flagged
+	anomalyRun    = 3    // consecutive samples that open or close an event
+	ewmaAlpha     = 0.01 // weight of each new sample in the EWMA, a window of about 100
+	hourlyKeep    = 30   // days kept for each hour-of-day median
+	hourlyMin     = 5    // days an hour needs before its median is used
+	maxAnomalies  = 50   // anomaly events kept per peer
+)
+
+////
+//  Baseline is a peer's rolling TCP RTT baseline, in msec, built from its
+//  normal (not anomalous) samples: a slow EWMA, and for each UTC hour of
+//  the day the mean of that hour on each of the last days, whose median is
+//  the baseline for that hour once there are enough days (so daily
+//  congestion is expected, not anomalous, while a shift that builds up
+//  over hours is still measured against the days before)
+type Baseline struct {
+	Ewma    float64
+	Samples int
+	Hourly  [24][]float64 `json:"-"`
+
+	hour    time.Time // the hour being summed into Hourly
+	hourSum float64
+	hourN   int
+}
+
+////
+//  Anomaly is a window in which a peer's TCP RTT stayed above its
+//  baseline by more than its anomaly factor
+type Anomaly struct {
+	Start    time.Time
+	End      time.Time `json:",omitempty"` // zero while ongoing
+	Baseline float64   // expected msec when it started
+	Peak     float64   // worst sample, msec
+	Samples  int       // anomalous samples in the window
+}
+
+////
+//  expected returns the baseline for a sample taken at now: the median of
+//  the hour's earlier days if there are enough, else the EWMA
+func (b *Baseline) expected(now time.Time) float64 {
+	hour := b.Hourly[now.Hour()]
+	if len(hour) < hourlyMin {
+		return b.Ewma
+	}
+	sorted := append([]float64(nil), hour...)
+	sort.Float64s(sorted)
+	if n := len(sorted); n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[len(sorted)/2]
+}
+
+func (b *Baseline) add(now time.Time, msec float64) {
+	// a plain mean until there are enough samples for the EWMA window
+	b.Samples++
+	alpha := math.Max(ewmaAlpha, 1/float64(b.Samples))
+	b.Ewma += alpha * (msec - b.Ewma)
+
+	if hour := now.Truncate(time.Hour); !hour.Equal(b.hour) {
+		b.closeHour()
+		b.hour = hour
+	}
+	b.hourSum += msec
+	b.hourN++
+}
+
+////
+//  closeHour adds the mean of the hour being summed to its Hourly days
+func (b *Baseline) closeHour() {
+	if b.hourN == 0 {
+		return
+	}
+	h := b.hour.Hour()
+	b.Hourly[h] = append(b.Hourly[h], b.hourSum/float64(b.hourN))
+	if len(b.Hourly[h]) > hourlyKeep {
+		b.Hourly[h] = b.Hourly[h][1:]
+	}
+	b.hourSum, b.hourN = 0, 0
+}
+
+////
+//  checkAnomaly compares a successful ping's TCP RTT with the peer's
+//  baseline, then adds it to the baseline unless it is anomalous, so an
+//  anomaly does not become the new normal.  An event opens after
+//  anomalyRun samples in a row exceed the baseline times the peer's
+//  AnomalyFactor, and ends after anomalyRun in a row do not.  The caller
+//  must hold p.mu.
+func (p *peer) checkAnomaly(msec float64) {
+	if p.AnomalyFactor <= 0 {
+		return
+	}
+	now := p.ms.clock.Now().UTC()
+	b := &p.Baseline
+	expected := b.expected(now)
+	high := b.Samples >= anomalyWarmup && msec > expected*p.AnomalyFactor
+	if !high {
+		b.add(now, msec)
+	}
+
+	open := len(p.Anomalies) > 0 && p.Anomalies[len(p.Anomalies)-1].End.IsZero()
+	if high == open {
+		p.anomalyRun = 0
+	} else {
+		p.anomalyRun++
+	}
+	if open {
+		a := p.Anomalies[len(p.Anomalies)-1]
+		if high {
+			a.Samples++
+			if msec > a.Peak {
+				a.Peak = msec
+			}
+		}
+		if p.anomalyRun >= anomalyRun {
+			p.anomalyRun = 0
+			a.End = now.Truncate(time.Second)
+			log.Println(p.srcLocation(), "to", p.Url, "latency back to baseline after", a.End.Sub(a.Start))
+		}
+		return
+	}
+
+	if !high {
+		p.pending = nil
+		return
+	}
+	if len(p.pending) == 0 {
+		p.pendingStart = now
+	}
+	p.pending = append(p.pending, msec)
+	if p.anomalyRun < anomalyRun {
+		return
+	}
+	p.anomalyRun = 0
+	a := &Anomaly{Start: p.pendingStart.Truncate(time.Second), Baseline: expected, Samples: len(p.pending)}
+	for _, s := range p.pending {
+		if s > a.Peak {
+			a.Peak = s
+		}
+	}
+	p.pending = nil
+	p.Anomalies = append(p.Anomalies, a)
+	if len(p.Anomalies) > maxAnomalies {
+		p.Anomalies = p.Anomalies[len(p.Anomalies)-maxAnomalies:]
+	}
+	client.LogSentryTags(sentry.LevelWarning, p.sentryTags(), "%s to %s: TCP RTT %.03f msec is over %.1f times its %.03f msec baseline",
+		p.srcLocation(), p.Url, msec, p.AnomalyFactor, expected)
+}
+
+////
+//  SetAnomalyFactor sets how many times its baseline a new peer's TCP RTT
+//  must be to count as anomalous; 0 (the default) turns anomaly detection
+//  off
+func (s *meshSrv) SetAnomalyFactor(factor float64) {
+	s.anomaly = factor
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckAnomaly(t *testing.T) {
+	start := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	ms := NewMeshServer("here", 0, 0, 10, 10, 0)
+	clock := NewVirtualClock(start)
+	ms.SetClock(clock)
+	if p := ms.NewPeer("http://example.com/off", "", "there"); p.AnomalyFactor != 0 {
+		t.Fatal("default anomaly factor", p.AnomalyFactor)
+	}
+	ms.SetAnomalyFactor(3)
+	p := ms.NewPeer("http://example.com/", "", "there")
+
+	rtts := []float64{10, 11, 9, 10, 12, 10, 9, 11, 10, 10, 10, 10}
+	rtts = append(rtts, 50, 10, 45, 60, 55, 40, 10, 11, 9, 10) // a spike, then an event
+	var spikeAt time.Time
+	for i, rtt := range rtts {
+		if i == 14 {
+			spikeAt = clock.Now()
+		}
+		p.checkAnomaly(rtt)
+		clock.Advance(10 * time.Second)
+	}
+	if len(p.Anomalies) != 1 {
+		t.Fatal("anomalies", p.Anomalies)
+	}
+	a := p.Anomalies[0]
+	if !a.Start.Equal(spikeAt) || a.End.IsZero() || a.Peak != 60 || a.Samples != 4 || a.Baseline < 9 || a.Baseline > 12 {
+		t.Error("anomaly", *a, "want start", spikeAt)
+	}
+	if p.Baseline.Ewma > 11 || p.Baseline.Samples != len(rtts)-5 {
+		t.Error("anomalous samples in baseline", p.Baseline.Ewma, p.Baseline.Samples)
+	}
+
+	hs := httptest.NewServer(ms.Handler())
+	defer hs.Close()
+	resp, err := hs.Client().Get(hs.URL + "/v1/peers/2/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var events struct {
+		Id        int
+		Anomalies []*Anomaly
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil || events.Id != 2 || len(events.Anomalies) != 1 {
+		t.Error("events", events, err)
+	}
+	if resp, err := hs.Client().Get(hs.URL + "/v1/peers/9/events"); err != nil || resp.StatusCode != 404 {
+		t.Error("unknown peer got", resp.StatusCode, err)
+	}
+}
+
+func TestBaselineHourly(t *testing.T) {
+	var b Baseline
+	day := time.Date(2019, 8, 1, 18, 30, 0, 0, time.UTC)
+	for d := 0; d < hourlyMin; d++ {
+		b.add(day.AddDate(0, 0, d).Add(-12*time.Hour), 10)
+		b.add(day.AddDate(0, 0, d), 35) // evening congestion
+		b.add(day.AddDate(0, 0, d).Add(time.Minute), 45)
+	}
+	// today's evening is not in the baseline until the hour is over
+	if e := b.expected(day.AddDate(0, 0, hourlyMin-1)); e != b.Ewma {
+		t.Error("evening baseline with", hourlyMin-1, "days", e)
+	}
+	b.add(day.AddDate(0, 0, hourlyMin).Add(-12*time.Hour), 10)
+	if e := b.expected(day.AddDate(0, 0, 7)); e != 40 {
+		t.Error("evening baseline", e)
+	}
+	if e := b.expected(day.Add(3 * time.Hour)); e != b.Ewma {
+		t.Error("unseen hour baseline", e, "want EWMA", b.Ewma)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultBwSize = 1000000          // bytes per bandwidth probe transfer
+	bwMaxTime     = 30 * time.Second // most time a bandwidth probe transfer may take
+)
+
+////
+//  BwStats summarizes a peer's bandwidth probes.  Rates are goodput in
+//  Mbit/s; the averages are over successful probes.
+type BwStats struct {
+	Probes   int       // number of successful probes
+	Fails    int       // number of failed probes
+	Latest   time.Time // time of the latest successful probe
+	DownMbps float64   // latest download rate (from the peer to us)
+	UpMbps   float64   // latest upload rate (from us to the peer)
+	DownAvg  float64
+	UpAvg    float64
+}
+
+func (b *BwStats) add(down, up float64) {
+	b.Probes++
+	b.DownMbps = down
+	b.UpMbps = up
+	b.DownAvg += (down - b.DownAvg) / float64(b.Probes)
+	b.UpAvg += (up - b.UpAvg) / float64(b.Probes)
+}
+
+////
+//  SetBandwidthProbe sets the default schedule for bandwidth probes of
+//  pingmesh peers: every delay seconds (0 turns them off), transferring
+//  size bytes each way.
+func (s *meshSrv) SetBandwidthProbe(delay int, size int64) {
+	s.bwDelay = delay
+	s.bwSize = size
+}
+
+////
+//  Bandwidth periodically downloads from and uploads to a pingmesh peer,
+//  on its own (slower) schedule.  A probe never overlaps a latency ping to
+//  the same peer.  It returns when the peer's Ping goroutine exits.
+func (p *peer) Bandwidth() {
+	defer p.ms.Done()
+	defer p.ms.addSleepers(-1)
+
+	u := client.ParseURL(p.Url)
+	if u == nil {
+		return
+	}
+	base := u.Scheme + "://" + u.Host
+	size := p.BwSize
+	if size <= 0 {
+		size = defaultBwSize
+	}
+
+	for {
+		if p.ms.DoneChan() == nil {
+			return
+		}
+		select {
+		case <-p.ms.clock.After(p.ms.jitterPct(p.BwDelay, 10)):
+		case <-p.stopped:
+			return
+		case _, more := <-p.ms.DoneChan():
+			if !more {
+				return
+			}
+			continue
+		}
+
+		var down, up *client.Transfer
+		var err error
+		func() {
+			p.probe.Lock() // no concurrent latency ping
+			defer p.probe.Unlock()
+			ctx, cancel := p.transferContext()
+			down, err = client.Download(ctx, base, p.PeerIP, size, p.fetchOptions())
+			cancel()
+			if err == nil {
+				ctx, cancel = p.transferContext()
+				up, err = client.Upload(ctx, base, p.PeerIP, size, p.fetchOptions())
+				cancel()
+			}
+		}()
+
+		p.mu.Lock()
+		if p.Bw == nil {
+			p.Bw = new(BwStats)
+		}
+		if err != nil {
+			p.Bw.Fails++
+		} else {
+			p.Bw.Latest = p.ms.clock.Now().UTC().Truncate(time.Second)
+			p.Bw.add(down.Mbps(), up.Mbps())
+		}
+		p.mu.Unlock()
+
+		if err != nil {
+			log.Println("bandwidth probe to", p.Url, "failed:", err)
+			continue
+		}
+
+		if p.ms.Verbose() > 0 {
+			fmt.Printf("bw %8.02f Mbps down %8.02f Mbps up %20s %s\n", down.Mbps(), up.Mbps(), p.Location, base)
+		}
+		if p.ms.CwFlag() {
+			myLocation := p.ms.SrvLocation()
+			publishMetric(myLocation, p.Location, "200", down.Mbps(), unitMbps, "Download Mbps", cwNamespace, p.metricDims())
+			publishMetric(myLocation, p.Location, "200", up.Mbps(), unitMbps, "Upload Mbps", cwNamespace, p.metricDims())
+		}
+	}
+}
+
+////
+//  transferContext bounds one bandwidth probe transfer, which holds off the
+//  peer's latency pings: it is done after the peer's ping delay (at most
+//  bwMaxTime), or as soon as the server is done or the peer stops
+func (p *peer) transferContext() (context.Context, context.CancelFunc) {
+	p.mu.Lock()
+	limit := time.Duration(p.Delay) * time.Second
+	p.mu.Unlock()
+	if limit <= 0 || limit > bwMaxTime {
+		limit = bwMaxTime
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), limit)
+	done := p.ms.DoneChan()
+	go func() {
+		select {
+		case <-done:
+		case <-p.stopped:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+////
+//  startPeer starts the goroutines for a new peer: Ping, and Bandwidth if
+//  it is a pingmesh peer with bandwidth probes turned on.
+func (ms *meshSrv) startPeer(p *peer) {
+	ms.Add() // for the ping goroutine
+	// set before the goroutine starts, since handlers read it unlocked
+	p.FirstPing = ms.clock.Now().UTC().Truncate(time.Second)
+	if p.AllIPs {
+		go p.FanOut() // which starts peers for the pinging
+		return
+	}
+	go p.Ping()
+
+	if u := client.ParseURL(p.Url); p.BwDelay > 0 && u != nil && client.IsPingmeshPeer(u.Path) {
+		ms.Add() // for the bandwidth goroutine
+		ms.addSleepers(1)
+		go p.Bandwidth()
+	}
+}
+
+func (s *meshSrv) addSleepers(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.numBw += n
+}
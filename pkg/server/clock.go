@@ -0,0 +1,159 @@
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+////
+//  Clock is the source of time for the ping loop.  The default realClock
+//  uses the time package; tests and simulation mode use a VirtualClock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+////
+//  SetClock replaces the server's clock.  Call it before adding peers.
+func (s *meshSrv) SetClock(c Clock) {
+	s.clock = c
+}
+
+////
+//  SetRandSeed replaces the server's random source (used for ping delay
+//  jitter) with one seeded by seed, so runs can be repeated exactly.
+func (s *meshSrv) SetRandSeed(seed int64) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	s.rnd = rand.New(rand.NewSource(seed))
+}
+
+////
+//  jitterPct is JitterPct using the server's random source
+func (s *meshSrv) jitterPct(secs, pct int) time.Duration {
+	s.rmu.Lock()
+	f := s.rnd.Float64()
+	s.rmu.Unlock()
+	return jitter(secs, pct, f)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+//  VirtualClock
+////////////////////////////////////////////////////////////////////////////////
+
+////
+//  VirtualClock is a Clock whose time only moves when told to.  Timers
+//  fire in deadline order as time is advanced past them.
+type VirtualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []timer // pending, sorted by deadline
+}
+
+type timer struct {
+	when time.Time
+	ch   chan time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := timer{c.now.Add(d), make(chan time.Time, 1)}
+	i := sort.Search(len(c.timers), func(i int) bool { return c.timers[i].when.After(t.when) })
+	c.timers = append(c.timers, timer{})
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	return t.ch
+}
+
+////
+//  Waiting returns the number of timers that have not fired
+func (c *VirtualClock) Waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+////
+//  Advance moves time forward by d, firing every timer that comes due.
+//  It returns the number of timers fired.
+func (c *VirtualClock) Advance(d time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.advanceTo(c.now.Add(d))
+}
+
+////
+//  Next moves time to the earliest pending deadline and fires the timers
+//  due then.  It returns the number fired (zero if none were pending).
+func (c *VirtualClock) Next() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return 0
+	}
+	return c.advanceTo(c.timers[0].when)
+}
+
+////
+//  FireAll moves time to the latest pending deadline, firing every timer
+func (c *VirtualClock) FireAll() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) == 0 {
+		return 0
+	}
+	return c.advanceTo(c.timers[len(c.timers)-1].when)
+}
+
+func (c *VirtualClock) advanceTo(t time.Time) int {
+	if t.After(c.now) {
+		c.now = t
+	}
+	n := 0
+	for n < len(c.timers) && !c.timers[n].when.After(c.now) {
+		c.timers[n].ch <- c.now
+		n++
+	}
+	c.timers = c.timers[n:]
+	return n
+}
+
+////
+//  Simulate drives a VirtualClock, which the caller has passed to SetClock:
+//  whenever every Sleeper is waiting on the clock it jumps to the next
+//  deadline, so pings run back to back while reporting the timestamps they
+//  would have had.  It returns when the server's done channel is closed.
+func (s *meshSrv) Simulate(c *VirtualClock) {
+	done := s.DoneChan()
+	if done == nil {
+		return
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+		}
+		if n := s.Sleepers(); n > 0 && c.Waiting() == n {
+			c.Next()
+		}
+	}
+}
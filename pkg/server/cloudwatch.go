@@ -0,0 +1,74 @@
+package server
+
+import (
+	"github.com/rafayopen/perftest/pkg/pt" // LocationOrIp
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	cwNamespace = "pingmesh"
+	unitMbps    = cloudwatch.StandardUnitMegabitsSecond
+	unitMsec    = cloudwatch.StandardUnitMilliseconds
+	unitCount   = cloudwatch.StandardUnitCount
+	cwMaxDims   = 30 // dimensions allowed per metric
+)
+
+////
+//  publishMetric is perftest's cw.PublishRespTime with a choice of unit, for
+//  metrics that are not response times.  It uses the same dimensions, plus
+//  one for each of labels (see peer.metricDims).
+func publishMetric(location, url, respCode string, value float64, unit, name, namespace string, labels map[string]string) {
+	sess := session.Must(session.NewSession())
+	svc := cloudwatch.New(sess)
+
+	dims := []*cloudwatch.Dimension{
+		&cloudwatch.Dimension{
+			Name:  aws.String("TestUrl"),
+			Value: aws.String(url),
+		},
+		&cloudwatch.Dimension{
+			Name:  aws.String("HTTP Resp Code"),
+			Value: aws.String(respCode),
+		},
+		&cloudwatch.Dimension{
+			Name:  aws.String("FromLocation"),
+			Value: aws.String(pt.LocationOrIp(&location)),
+		},
+	}
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(dims) == cwMaxDims {
+			log.Println("CloudWatch allows", cwMaxDims, "dimensions, dropping label", key)
+			continue
+		}
+		dims = append(dims, &cloudwatch.Dimension{Name: aws.String(key), Value: aws.String(labels[key])})
+	}
+
+	timestamp := time.Now()
+	_, err := svc.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace: aws.String(namespace),
+		MetricData: []*cloudwatch.MetricDatum{
+			&cloudwatch.MetricDatum{
+				Timestamp:  &timestamp,
+				MetricName: aws.String(name),
+				Value:      aws.Float64(value),
+				Unit:       aws.String(unit),
+				Dimensions: dims,
+			},
+		},
+	})
+	if err != nil {
+		log.Println("Error publishing", name, "for", url, "from", location, "to cloudwatch:", err)
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"github.com/rafayopen/perftest/pkg/pt"
+
+	"math"
+)
+
+////
+//  SetGeo sets the server's structured location, which it sends in its
+//  JSON pongs and /v1/peers so peers can tell how far away it is
+func (s *meshSrv) SetGeo(geo *client.Geo) {
+	s.Geo = geo
+}
+
+////
+//  updateFloor computes the peer's distance from this server and the
+//  light-in-fiber RTT floor for it, and how far the average TCP RTT is
+//  above the floor, if both locations have coordinates.  The caller must
+//  hold p.mu.
+func (p *peer) updateFloor() {
+	if !p.ms.Geo.HasCoords() || !p.Geo.HasCoords() {
+		return
+	}
+	km := client.DistanceKm(p.ms.Geo, p.Geo)
+	p.DistanceKm = math.Round(km*10) / 10
+	p.FloorMs = pt.Msec(client.MinRtt(km))
+	if p.Pings > 0 {
+		p.AboveFloor = pt.Msec(p.PingTotals.TcpHs)/float64(p.Pings) - p.FloorMs
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC status codes used below (google.golang.org/grpc/codes)
+const (
+	grpcOK            = 0
+	grpcInvalidArg    = 3
+	grpcNotFound      = 5
+	grpcUnimplemented = 12
+)
+
+////
+//  h2cHandler lets the plain HTTP listener also serve HTTP/2 with prior
+//  knowledge, which gRPC clients (and grpc:// probes) use.
+func (ms *meshSrv) h2cHandler() http.Handler {
+	return h2c.NewHandler(ms.mux, &http2.Server{})
+}
+
+////
+//  GRPCHandler serves the two gRPC methods pingmesh implements:
+//  grpc.health.v1.Health/Check, which reports SERVING for the whole server
+//  ("") and the "pingmesh" service while it is running, and
+//  pingmesh.v1.Mesh/Ping, which replies with this server's location and
+//  receive and send timestamps like the JSON /v1/ping response.
+func (s *meshSrv) GRPCHandler(w http.ResponseWriter, r *http.Request) {
+	recv := time.Now()
+	s.Requests++
+
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), client.GRPCContentType) {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	msg, err := client.ReadGRPCFrame(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		grpcReply(w, grpcInvalidArg, err.Error(), nil)
+		return
+	}
+
+	switch r.URL.Path {
+	case client.GRPCHealthCheck:
+		service, err := client.ParseHealthCheck(msg)
+		switch {
+		case err != nil:
+			grpcReply(w, grpcInvalidArg, err.Error(), nil)
+		case service != "" && service != "pingmesh":
+			grpcReply(w, grpcNotFound, "unknown service", nil)
+		case s.DoneChan() == nil:
+			// shutting down
+			grpcReply(w, grpcOK, "", client.ProtoVarint(nil, 1, client.HealthNotServing))
+		default:
+			grpcReply(w, grpcOK, "", client.ProtoVarint(nil, 1, client.HealthServing))
+		}
+
+	case client.GRPCMeshPing:
+		pong := client.Pong{
+			SrvLoc: s.SrvLoc,
+			Recv:   recv.UnixNano(),
+			Send:   recv.Add(time.Since(recv)).UnixNano(),
+		}
+		grpcReply(w, grpcOK, "", client.MeshPing(&pong))
+
+	default:
+		grpcReply(w, grpcUnimplemented, "unknown method "+r.URL.Path, nil)
+	}
+}
+
+////
+//  grpcReply writes msg (unless the call failed) followed by the status
+//  trailers
+func grpcReply(w http.ResponseWriter, code int, message string, msg []byte) {
+	w.Header().Set("Content-Type", client.GRPCContentType)
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if code == grpcOK {
+		w.Write(client.GRPCFrame(msg))
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if len(message) > 0 {
+		w.Header().Set("Grpc-Message", message)
+	}
+}
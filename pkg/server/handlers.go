@@ -3,10 +3,16 @@ package server
 import (
 	"github.com/rafayopen/pingmesh/pkg/client" // fetchurl
 
+	"golang.org/x/net/websocket"
+
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"sort"
 	"strconv"
@@ -33,6 +39,7 @@ type metrics struct {
 	NumActive  int
 	NumDeleted int
 	MemStats   *MemStatSummary
+	Resolver   client.ResolverStats // DNS cache (see client.Resolver)
 }
 
 func (s *meshSrv) SetupRoutes() {
@@ -41,13 +48,19 @@ func (s *meshSrv) SetupRoutes() {
 		{"/v1", "", s.RootHandler},
 		{"/v1/env", "", s.envHandler},
 		{"/v1/ping", "get a ping response", s.PingHandler},
-		{"/v1/peers", "get a list of peers", s.PeersHandler},
+		{"/v1/peers", "get a list of peers (POST a JSON PeerSpec to add one)", s.PeersHandler},
+		{"/v1/peers/", "", s.PeerEventsHandler}, // /v1/peers/{id}/events
+		{"/v1/verdicts", "get the consensus of vantage points on each target's health", s.VerdictsHandler},
 		{"/v1/addpeer", "add a ping peer (takes ip, port, hostname)", s.AddPingHandler},
+		{"/v1/sink", "", s.SinkHandler},
+		{"/v1/ws", "", s.WSHandler},
+		{client.GRPCHealthCheck, "", s.GRPCHandler},
+		{client.GRPCMeshPing, "", s.GRPCHandler},
 		{"/v1/metrics", "get memory statistics", s.MetricsHandler},
 		{"/v1/quit", "shut down this pinger", s.QuitHandler},
 	}
 	for _, route := range s.routes {
-		http.HandleFunc(route.uri, route.handler)
+		s.mux.HandleFunc(route.uri, route.handler)
 	}
 }
 
@@ -57,7 +70,6 @@ func (s *meshSrv) SetupRoutes() {
 
 var (
 	htmlTrailer string = "\n</body></html>\n"
-	routelist   string
 )
 
 func htmlHeader(title string) string {
@@ -75,20 +87,20 @@ func (s *meshSrv) RootHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// return default pages with links to other API endpoints
-		if len(routelist) == 0 { // TODO: or if routes changed...
-			routelist = "<ul>\n"
+		if len(s.routelist) == 0 { // TODO: or if routes changed...
+			s.routelist = "<ul>\n"
 			for _, route := range s.routes {
 				if len(route.doc) > 0 {
-					routelist += bullet(route.uri, route.doc)
+					s.routelist += bullet(route.uri, route.doc)
 				}
 			}
-			routelist += "</ul>\n"
+			s.routelist += "</ul>\n"
 		}
 
 		response := htmlHeader(s.SrvLoc)
 		response += "<h1> pingmesh </h1>"
 		response += "<p>Accessible URLs are:\n"
-		response += routelist
+		response += s.routelist
 		response += client.ServedFromPrefix + s.SrvLoc + client.ServedFromSuffix
 		response += htmlTrailer
 
@@ -112,6 +124,7 @@ func (s *meshSrv) MetricsHandler(w http.ResponseWriter, r *http.Request) {
 			NumPeers:   s.NumActive + s.NumDeleted,
 			NumActive:  s.NumActive,
 			NumDeleted: s.NumDeleted,
+			Resolver:   client.DefaultResolver.Stats(),
 		}
 
 		enc := json.NewEncoder(w)
@@ -158,7 +171,10 @@ You may specify an optional IP address (default is to lookup the hostname),
 this will send the request to that IP address with the hostname in the URL.
 <br>Example <em>https://www.google.com/</em> will collect perf data from google,
 or <em>https://pingmesh.run.rafay-edge.net/v1/ping</em> to measure to a peer
-(in this case you should use an IP override, else it will ping itself).</p>
+(in this case you should use an IP override, else it will ping itself).
+Use <em>tcp://host:port</em> to time just the TCP connection to a non-HTTP server.
+A peer's /v1/ping accepts <em>size=</em> (bytes of padding), <em>random=true</em>,
+<em>delay=</em> (msec of server think time) and <em>status=</em> (response code).</p>
 
 <form action="/v1/addpeer">
 <br>URL: <input type="text" name="url" value="https://rafay.co">
@@ -178,7 +194,7 @@ or <em>https://pingmesh.run.rafay-edge.net/v1/ping</em> to measure to a peer
 		return
 	}
 	if len(urls) > 1 {
-		reply += `<p><b>Warning: Only one URL accepted</b>, but ` + string(len(urls)) + `supplied</p>\n`
+		reply += `<p><b>Warning: Only one URL accepted</b>, but ` + strconv.Itoa(len(urls)) + ` supplied</p>\n`
 	}
 
 	url := strings.Trim(urls[0], " \t")
@@ -186,9 +202,8 @@ or <em>https://pingmesh.run.rafay-edge.net/v1/ping</em> to measure to a peer
 	if ap := strings.Index(url, "addpeers"); ap > 0 {
 		addpeers = strings.Index(url[ap:], "true") > 0
 	}
-	if qi := strings.Index(url, "?"); qi > 0 {
-		url = url[:qi] // trim query string from target URL
-	}
+	// trim addpeers from the target URL, but keep others (e.g., ping size=)
+	url = trimQueryParam(url, "addpeers")
 	var ip, override string // optional IP override
 
 	if len(ips) > 0 {
@@ -197,22 +212,32 @@ or <em>https://pingmesh.run.rafay-edge.net/v1/ping</em> to measure to a peer
 			override = " (with IP override " + ip + ")"
 		}
 		if len(ips) > 1 {
-			reply += `<p><b>Warning: Only one IP override accepted</b>, but ` + string(len(ips)) + `supplied</p>\n`
+			reply += `<p><b>Warning: Only one IP override accepted</b>, but ` + strconv.Itoa(len(ips)) + ` supplied</p>\n`
 		}
 	}
-
-	if peer, err := s.AddPingTarget(url, ip, client.LocUnknown); err != nil {
-		log.Println("error", err, "adding peer", peer)
-		if err == PeerAlreadyPresent {
-			reply += `<p>Peer was already in the peer list since ` + peer.FirstPing.String() + `:
-<br>Url: ` + peer.Url + `
-<br>IP: ` + peer.PeerIP + `</p><p><a href="/v1/peers">Click here</a> for JSON peer list.`
+	var sources []string // ping from each of these (default: the server's)
+	for _, source := range qs["source"] {
+		if err := client.ValidSource(source); err != nil {
+			log.Println("could not parse source parameter:", err)
+			continue
+		}
+		sources = append(sources, source)
+	}
+	var family string // default: the server's
+	if fv := qs["family"]; len(fv) > 0 {
+		if fv[0] == FamilyBoth || client.ValidFamily(fv[0]) {
+			family = fv[0]
 		} else {
-			reply += `<p>Unknown error: ` + err.Error()
+			log.Println("could not parse family parameter", fv[0])
 		}
-	} else { // err == nil, peer had better != nil
+	}
+
+	////
+	// Apply the optional overrides before the ping goroutine starts so it
+	// sees them on its first pass (see peers.go:addPingTarget)
+	setup := func(peer *peer) {
 		if lv := qs["limit"]; len(lv) > 0 {
-			if limit, err := strconv.Atoi(lv[0]); err == nil {
+			if limit, err := strconv.Atoi(lv[0]); err == nil && limit >= 0 {
 				log.Println("got limit", limit)
 				peer.Limit = limit
 			} else {
@@ -220,7 +245,7 @@ or <em>https://pingmesh.run.rafay-edge.net/v1/ping</em> to measure to a peer
 			}
 		}
 		if dv := qs["delay"]; len(dv) > 0 {
-			if delay, err := strconv.Atoi(dv[0]); err == nil {
+			if delay, err := strconv.Atoi(dv[0]); err == nil && delay > 0 {
 				log.Println("got delay", delay)
 				peer.Delay = delay
 			} else {
@@ -228,21 +253,123 @@ or <em>https://pingmesh.run.rafay-edge.net/v1/ping</em> to measure to a peer
 			}
 		}
 		if fv := qs["fails"]; len(fv) > 0 {
-			if fails, err := strconv.Atoi(fv[0]); err == nil {
+			if fails, err := strconv.Atoi(fv[0]); err == nil && fails >= 0 {
 				log.Println("got fails", fails)
 				peer.Maxfail = fails
 			} else {
 				log.Println("could not parse fails parameter", fv[0])
 			}
 		}
+		if bv := qs["bwdelay"]; len(bv) > 0 {
+			if bwdelay, err := strconv.Atoi(bv[0]); err == nil && bwdelay >= 0 {
+				log.Println("got bwdelay", bwdelay)
+				peer.BwDelay = bwdelay
+			} else {
+				log.Println("could not parse bwdelay parameter", bv[0])
+			}
+		}
+		if bv := qs["bwsize"]; len(bv) > 0 {
+			if bwsize, err := strconv.ParseInt(bv[0], 10, 64); err == nil && client.ValidTransferSize(bwsize) == nil {
+				log.Println("got bwsize", bwsize)
+				peer.BwSize = bwsize
+			} else {
+				log.Println("could not parse bwsize parameter", bv[0])
+			}
+		}
+		if pv := qs["proto"]; len(pv) > 0 {
+			if client.ValidProto(pv[0]) {
+				log.Println("got proto", pv[0])
+				peer.Proto = pv[0]
+			} else {
+				log.Println("could not parse proto parameter", pv[0])
+			}
+		}
+		if mv := qs["method"]; len(mv) > 0 {
+			peer.Method = strings.ToUpper(mv[0])
+		}
+		for _, hv := range qs["header"] { // Name:Value, may repeat
+			if colon := strings.Index(hv, ":"); colon > 0 {
+				if peer.Headers == nil {
+					peer.Headers = make(headerMap)
+				}
+				peer.Headers[strings.TrimSpace(hv[:colon])] = strings.TrimSpace(hv[colon+1:])
+			} else {
+				log.Println("could not parse header parameter", hv)
+			}
+		}
+		if bv := qs["body"]; len(bv) > 0 {
+			peer.Body = bv[0]
+		}
+		if pv := qs["proxy"]; len(pv) > 0 {
+			if pv[0] == noProxy {
+				peer.Proxy = ""
+			} else if err := client.ValidProxy(pv[0]); err == nil {
+				log.Println("got proxy", client.RedactURL(pv[0]))
+				peer.Proxy = proxyURL(pv[0])
+			} else {
+				log.Println("could not parse proxy parameter:", err)
+			}
+		}
+		if lv := qs["label"]; len(lv) > 0 { // key:value, may repeat
+			if labels, err := ParseLabels(lv...); err == nil {
+				peer.Labels = labels
+			} else {
+				log.Println("could not parse label parameter:", err)
+			}
+		}
+		if av := qs["anomaly"]; len(av) > 0 {
+			if factor, err := strconv.ParseFloat(av[0], 64); err == nil {
+				log.Println("got anomaly", factor)
+				peer.AnomalyFactor = factor
+			} else {
+				log.Println("could not parse anomaly parameter", av[0])
+			}
+		}
+		if av := qs["all_ips"]; len(av) > 0 {
+			peer.AllIPs, _ = strconv.ParseBool(av[0])
+		}
+		if rv := qs["resolve"]; len(rv) > 0 {
+			if resolve, err := strconv.Atoi(rv[0]); err == nil && resolve >= 0 {
+				log.Println("got resolve", resolve)
+				peer.Resolve = resolve
+			} else {
+				log.Println("could not parse resolve parameter", rv[0])
+			}
+		}
+		if fv := qs["follow_redirects"]; len(fv) > 0 {
+			if hops, err := strconv.Atoi(fv[0]); err == nil && hops >= 0 {
+				log.Println("got follow_redirects", hops)
+				peer.FollowRedirects = hops
+			} else {
+				log.Println("could not parse follow_redirects parameter", fv[0])
+			}
+		}
+		if expect := parseExpect(qs); expect != nil {
+			if err := expect.Compile(); err == nil {
+				peer.Expect = expect
+			} else {
+				log.Println("could not parse expect parameters:", err)
+			}
+		}
+	}
 
+	if peer, err := s.addPingTarget(url, ip, client.LocUnknown, sources, family, setup); err != nil {
+		log.Println("error", err, "adding peer", url)
+		if err == PeerAlreadyPresent {
+			reply += `<p>Peer was already in the peer list since ` + peer.FirstPing.String() + `:
+<br>Url: ` + peer.Url + `
+<br>IP: ` + peer.PeerIP + `</p><p><a href="/v1/peers">Click here</a> for JSON peer list.`
+		} else {
+			reply += `<p>Unknown error: ` + err.Error()
+		}
+	} else { // err == nil, peer had better != nil
 		log.Println("added peer", url+override)
 		reply += `<p>Added a new peer for ` + url + override + `
 <p><a href="/v1/peers">Click here</a> for JSON peer list.`
 		////
 		// Now see if we are supposed to add this peer's peers
 		if addpeers {
-			log.Println("starting thread to addpeers from", peer)
+			log.Println("starting thread to addpeers from", peer.Url)
 			peer.ms.Add()           // for the AddPeers goroutine
 			go peer.AddPeersPeers() // must call Done()
 		}
@@ -261,33 +388,55 @@ func (s *meshSrv) PeersHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		////
-		// TODO: Decide if we want to PUSH data at peers, or let each
-		// one PULL data from peers they connect to, and decide to ping
-		// those peers itself, rather than instructing someone else ...
-		////
-		body, err := ioutil.ReadAll(r.Body)
+		// Add the peers described by a JSON PeerSpec or array of them
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
 		if err != nil {
 			http.Error(w, "Error reading request body",
 				http.StatusInternalServerError)
+			return
+		}
+		specs, err := ParsePeerSpecs(body)
+		if err != nil {
+			http.Error(w, "Error parsing peer spec: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		// decode body into JSON ... if properly formatted
-		// or use argument parameters to control
-		_ = body
-
-		// handle incoming peer data
-
-		// write response
-		w.Write([]byte("Peer POST not implemented"))
+		type added struct {
+			Url   string
+			Error string `json:",omitempty"`
+		}
+		var reply []added
+		for i := range specs {
+			a := added{Url: specs[i].Url}
+			if _, err := s.AddPeerSpec(&specs[i]); err != nil {
+				a.Error = err.Error()
+			} else {
+				log.Println("added peer", a.Url)
+			}
+			reply = append(reply, a)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		w.Header().Set("Content-Type", "application/json")
+		enc.Encode(reply)
 
 	case "GET":
-		// write response
+		// write response, with only the peers matching any label= selectors
 		enc := json.NewEncoder(w)
 		enc.SetIndent("", "  ")
+		sels := selectors(r.URL.Query()["label"])
 		func() {
 			s.mu.Lock()
 			defer s.mu.Unlock()
-			if err := enc.Encode(s); err != nil {
+			var view interface{} = s
+			if len(sels) > 0 {
+				view = struct {
+					*meshSrv
+					Peers    []*peer
+					DelPeers []*peer
+				}{s, matchPeers(s.Peers, sels), matchPeers(s.DelPeers, sels)}
+			}
+			if err := enc.Encode(view); err != nil {
 				http.Error(w, "Error converting peer to json",
 					http.StatusInternalServerError)
 			}
@@ -299,7 +448,141 @@ func (s *meshSrv) PeersHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+////
+//  PeerEventsHandler serves /v1/peers/{id}/events: the latency anomalies
+//  and serving IP changes of the peer with that Id, active or deleted
+func (s *meshSrv) PeerEventsHandler(w http.ResponseWriter, r *http.Request) {
+	s.Requests++
+
+	if r.Method != "GET" {
+		reason := "Invalid request method: " + r.Method
+		http.Error(w, reason, http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/peers/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 || parts[1] != "events" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var found *peer
+	func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, p := range append(s.Peers, s.DelPeers...) {
+			if p.Id == id {
+				found = p
+				break
+			}
+		}
+	}()
+	if found == nil {
+		http.Error(w, "No peer with Id "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	type events struct {
+		Id        int
+		Url       string
+		Anomalies []*Anomaly
+		IPChanges []IPChange
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	found.mu.Lock()
+	defer found.mu.Unlock()
+	enc.Encode(events{found.Id, found.Url, found.Anomalies, found.IPChanges})
+}
+
+////
+//  parseExpect builds response assertions from addpeer parameters, or
+//  returns nil if there are none: expect_status=200,204 expect_body=text
+//  expect_regex=re expect_json=path=value expect_maxbody=bytes and
+//  expect_header=Name[:value] (json and header may repeat)
+func parseExpect(qs url.Values) *client.Expect {
+	var e client.Expect
+	found := false
+	for _, sv := range qs["expect_status"] {
+		for _, s := range strings.Split(sv, ",") {
+			if code, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+				e.Status = append(e.Status, code)
+				found = true
+			} else {
+				log.Println("could not parse expect_status parameter", sv)
+			}
+		}
+	}
+	if bv := qs["expect_body"]; len(bv) > 0 {
+		e.Contains = bv[0]
+		found = true
+	}
+	if rv := qs["expect_regex"]; len(rv) > 0 {
+		e.Regexp = rv[0]
+		found = true
+	}
+	for _, jv := range qs["expect_json"] {
+		if eq := strings.Index(jv, "="); eq > 0 {
+			if e.JSON == nil {
+				e.JSON = make(map[string]string)
+			}
+			e.JSON[jv[:eq]] = jv[eq+1:]
+			found = true
+		} else {
+			log.Println("could not parse expect_json parameter", jv)
+		}
+	}
+	if mv := qs["expect_maxbody"]; len(mv) > 0 {
+		if max, err := strconv.ParseInt(mv[0], 10, 64); err == nil {
+			e.MaxBody = max
+			found = true
+		} else {
+			log.Println("could not parse expect_maxbody parameter", mv[0])
+		}
+	}
+	for _, hv := range qs["expect_header"] {
+		if e.Header == nil {
+			e.Header = make(map[string]string)
+		}
+		name, value := hv, ""
+		if colon := strings.Index(hv, ":"); colon > 0 {
+			name, value = hv[:colon], strings.TrimSpace(hv[colon+1:])
+		}
+		e.Header[strings.TrimSpace(name)] = value
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return &e
+}
+
+////
+//  trimQueryParam removes the named parameter from rawurl's query string
+func trimQueryParam(rawurl, name string) string {
+	qi := strings.Index(rawurl, "?")
+	if qi < 0 {
+		return rawurl
+	}
+	qs, err := url.ParseQuery(rawurl[qi+1:])
+	if err != nil {
+		return rawurl[:qi] // can not parse it, drop it all
+	}
+	qs.Del(name)
+	if len(qs) == 0 {
+		return rawurl[:qi]
+	}
+	return rawurl[:qi] + "?" + qs.Encode()
+}
+
+////
+//  PingHandler returns a short HTML page with this server's location, or
+//  if the request accepts application/json, a client.Pong with the times
+//  the request was received and the response sent.  Query parameters
+//  shape the response (see parsePingOptions).
 func (s *meshSrv) PingHandler(w http.ResponseWriter, r *http.Request) {
+	recv := time.Now()
 	s.Requests++
 	//log.Println("PingHandler")
 
@@ -317,13 +600,194 @@ func (s *meshSrv) PingHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("PeersHandler POST not implemented\n"))
 
 	case "GET":
+		opts, err := parsePingOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if opts.delay > 0 {
+			select {
+			case <-time.After(opts.delay):
+			case <-r.Context().Done():
+				return // client went away
+			}
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			pong := client.Pong{
+				SrvLoc:   s.SrvLoc,
+				Geo:      s.Geo,
+				Verdicts: s.pongVerdicts(),
+				Node:     s.node,
+				Recv:     recv.UnixNano(),
+				// add monotonic elapsed time, in case the wall clock steps
+				Send: recv.Add(time.Since(recv)).UnixNano(),
+			}
+			// indent: client parses `"SrvLoc": "` for location
+			body, err := json.MarshalIndent(pong, "", "  ")
+			if err != nil {
+				http.Error(w, "Error converting pong to json",
+					http.StatusInternalServerError)
+				return
+			}
+			if opts.random && opts.size > 0 {
+				// the whole pong, then raw random bytes outside it
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.WriteHeader(opts.status)
+				w.Write(append(body, '\n'))
+				writePad(w, opts.size, true)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(opts.status)
+			if opts.size > 0 {
+				// splice in Pad as the last member, after the timestamps
+				w.Write(body[:len(body)-2]) // trim "\n}"
+				w.Write([]byte(",\n  \"Pad\": \""))
+				writePad(w, opts.size, false)
+				w.Write([]byte("\"\n}\n"))
+			} else {
+				w.Write(append(body, '\n'))
+			}
+			return
+		}
+
 		// write response
 		response := htmlHeader(s.SrvLoc)
 		response += "<h1> pingResponse </h1>"
 		response += client.ServedFromPrefix + s.SrvLoc + client.ServedFromSuffix
-		response += htmlTrailer
 
+		if opts.random && opts.size > 0 {
+			// the whole page, then raw random bytes outside it
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.WriteHeader(opts.status)
+			w.Write([]byte(response + htmlTrailer))
+			writePad(w, opts.size, true)
+			return
+		}
+		w.WriteHeader(opts.status)
 		w.Write([]byte(response))
+		if opts.size > 0 {
+			w.Write([]byte("<!--\n"))
+			writePad(w, opts.size, false)
+			w.Write([]byte("\n-->"))
+		}
+		w.Write([]byte(htmlTrailer))
+
+	default:
+		reason := "Invalid request method: " + r.Method
+		http.Error(w, reason, http.StatusMethodNotAllowed)
+	}
+}
+
+const (
+	maxPongSize  = client.MaxTransferSize // limit on size=
+	maxPongDelay = time.Minute
+)
+
+////
+//  pingOptions shape the ping response
+type pingOptions struct {
+	size   int64         // bytes of padding to add to the response
+	random bool          // make the padding raw random bytes (incompressible)
+	delay  time.Duration // server think time before responding
+	status int           // HTTP status to respond with
+}
+
+////
+//  parsePingOptions reads the optional ping query parameters:
+//  - size=    (bytes of padding to send, up to 1GB)      1000000
+//  - random=  (if true, padding is raw random bytes)     true
+//  - delay=   (msec, or a duration, up to one minute)    250 or 1.5s
+//  - status=  (HTTP status code to return)               503
+func parsePingOptions(qs url.Values) (opts pingOptions, err error) {
+	opts.status = http.StatusOK
+
+	if v := qs.Get("size"); len(v) > 0 {
+		if opts.size, err = strconv.ParseInt(v, 10, 64); err != nil || opts.size < 0 || opts.size > maxPongSize {
+			return opts, fmt.Errorf("size must be 0 to %d bytes", maxPongSize)
+		}
+	}
+	if v := qs.Get("random"); len(v) > 0 {
+		if opts.random, err = strconv.ParseBool(v); err != nil {
+			return opts, fmt.Errorf("random must be true or false")
+		}
+	}
+	if v := qs.Get("delay"); len(v) > 0 {
+		if msec, err := strconv.Atoi(v); err == nil {
+			opts.delay = time.Duration(msec) * time.Millisecond
+		} else if opts.delay, err = time.ParseDuration(v); err != nil {
+			return opts, fmt.Errorf("delay must be msec or a duration like 1.5s")
+		}
+		if opts.delay < 0 || opts.delay > maxPongDelay {
+			return opts, fmt.Errorf("delay must be 0 to %s", maxPongDelay)
+		}
+	}
+	if v := qs.Get("status"); len(v) > 0 {
+		if opts.status, err = strconv.Atoi(v); err != nil || opts.status < 200 || opts.status > 599 {
+			return opts, fmt.Errorf("status must be 200 to 599")
+		}
+	}
+	return opts, nil
+}
+
+////
+//  writePad writes size bytes of padding to w: 'x' characters, or raw
+//  random bytes, which no proxy or gzip path can compress (random
+//  characters from a 62-letter alphabet would still shrink by a quarter)
+func writePad(w io.Writer, size int64, random bool) {
+	buf := make([]byte, 32*1024)
+	var rnd *rand.Rand
+	if random {
+		rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	} else {
+		for i := range buf {
+			buf[i] = 'x'
+		}
+	}
+
+	for size > 0 {
+		n := int64(len(buf))
+		if size < n {
+			n = size
+		}
+		if random { // fresh bytes for every chunk
+			rnd.Read(buf[:n])
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+}
+
+////
+//  sinkReply is the JSON response to an upload
+type sinkReply struct {
+	SrvLoc string
+	Bytes  int64         // request body bytes received
+	Read   time.Duration // time spent reading them
+}
+
+////
+//  SinkHandler reads and discards a POSTed body, the upload half of a
+//  bandwidth probe, and reports how much it read.
+func (s *meshSrv) SinkHandler(w http.ResponseWriter, r *http.Request) {
+	s.Requests++
+
+	switch r.Method {
+	case "POST":
+		start := time.Now()
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(r.Body, maxPongSize))
+		if err != nil {
+			http.Error(w, "Error reading request body",
+				http.StatusInternalServerError)
+			return
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		w.Header().Set("Content-Type", "application/json")
+		enc.Encode(sinkReply{s.SrvLoc, n, time.Since(start)})
 
 	default:
 		reason := "Invalid request method: " + r.Method
@@ -331,6 +795,15 @@ func (s *meshSrv) PingHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+////
+//  WSHandler upgrades to a WebSocket that echoes each message, for ws://
+//  probes.  Any Origin is accepted: the clients are other pingmesh nodes,
+//  not browsers.
+func (s *meshSrv) WSHandler(w http.ResponseWriter, r *http.Request) {
+	s.Requests++
+	websocket.Server{Handler: client.ServeWSEcho}.ServeHTTP(w, r)
+}
+
 ////
 //  envHandler dumps the shell environment, server and peer state
 func (s *meshSrv) envHandler(w http.ResponseWriter, r *http.Request) {
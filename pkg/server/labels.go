@@ -0,0 +1,132 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"errors"
+	"sort"
+	"strings"
+)
+
+////
+//  Labels are key:value pairs describing a server or a peer (region,
+//  provider, env, cluster ...), so a large mesh can be sliced by them
+type Labels map[string]string
+
+////
+//  ParseLabels parses labels written key:value, in any number of strings
+//  that may each hold a comma-separated list
+func ParseLabels(lists ...string) (Labels, error) {
+	var labels Labels
+	for _, list := range lists {
+		for _, kv := range strings.Split(list, ",") {
+			if kv = strings.TrimSpace(kv); len(kv) == 0 {
+				continue
+			}
+			colon := strings.Index(kv, ":")
+			if colon <= 0 {
+				return nil, errors.New("label " + kv + " is not key:value")
+			}
+			if labels == nil {
+				labels = make(Labels)
+			}
+			labels[strings.TrimSpace(kv[:colon])] = strings.TrimSpace(kv[colon+1:])
+		}
+	}
+	return labels, nil
+}
+
+////
+//  Match is true if the labels satisfy every selector: key:value needs
+//  that value, and a bare key needs the key with any value
+func (l Labels) Match(selectors []string) bool {
+	for _, sel := range selectors {
+		key, value := sel, ""
+		colon := strings.Index(sel, ":")
+		if colon >= 0 {
+			key, value = sel[:colon], sel[colon+1:]
+		}
+		v, found := l[key]
+		if !found || colon >= 0 && v != value {
+			return false
+		}
+	}
+	return true
+}
+
+////
+//  String returns the labels as a sorted key:value list, like ParseLabels
+//  takes
+func (l Labels) String() string {
+	var kvs []string
+	for k, v := range l {
+		kvs = append(kvs, k+":"+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+////
+//  SetLabels sets the server's own labels, which are reported in
+//  /v1/peers, added to its CloudWatch metrics and tagged on its Sentry
+//  events
+func (s *meshSrv) SetLabels(labels Labels) {
+	s.Labels = labels
+	client.SetSentryTags(labels)
+}
+
+////
+//  selectors returns the label= query parameters, splitting any comma lists
+func selectors(values []string) []string {
+	var sels []string
+	for _, v := range values {
+		for _, sel := range strings.Split(v, ",") {
+			if sel = strings.TrimSpace(sel); len(sel) > 0 {
+				sels = append(sels, sel)
+			}
+		}
+	}
+	return sels
+}
+
+////
+//  matchPeers returns the peers whose labels satisfy sels
+func matchPeers(peers []*peer, sels []string) []*peer {
+	var matched []*peer
+	for _, p := range peers {
+		if p.Labels.Match(sels) {
+			matched = append(matched, p)
+		}
+	}
+	return matched
+}
+
+////
+//  metricDims returns the labels to add as CloudWatch dimensions to a
+//  peer's metrics: the server's as "From key", the peer's as "To key"
+func (p *peer) metricDims() map[string]string {
+	if len(p.ms.Labels) == 0 && len(p.Labels) == 0 {
+		return nil
+	}
+	dims := make(map[string]string)
+	for k, v := range p.ms.Labels {
+		dims["From "+k] = v
+	}
+	for k, v := range p.Labels {
+		dims["To "+k] = v
+	}
+	return dims
+}
+
+////
+//  sentryTags returns the peer's labels as Sentry tags, "peer.key"
+func (p *peer) sentryTags() map[string]string {
+	var tags map[string]string
+	for k, v := range p.Labels {
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags["peer."+k] = v
+	}
+	return tags
+}
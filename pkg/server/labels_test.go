@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	l, err := ParseLabels("region:us-west, provider:aws", "env:prod,url:http://x")
+	if err != nil || len(l) != 4 || l["url"] != "http://x" {
+		t.Fatal("parsed", l, err)
+	}
+	if s := l.String(); s != "env:prod,provider:aws,region:us-west,url:http://x" {
+		t.Error("string", s)
+	}
+	if _, err := ParseLabels("region"); err == nil {
+		t.Error("want error for a label without a value")
+	}
+
+	cases := []struct {
+		sels  []string
+		match bool
+	}{
+		{nil, true},
+		{[]string{"region:us-west"}, true},
+		{[]string{"region:us-west", "env"}, true},
+		{[]string{"region:eu-central"}, false},
+		{[]string{"cluster"}, false},
+		{[]string{"env:"}, false},
+	}
+	for n, c := range cases {
+		if l.Match(c.sels) != c.match {
+			t.Error("case", n, c.sels, "want match", c.match)
+		}
+	}
+}
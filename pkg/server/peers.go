@@ -29,22 +29,101 @@ import (
 //  meshSrv instance referenced in peer holds the array of peer objects that are
 //  currently active.  Members must be exported for JSON to dump them.
 type peer struct {
+	Id       int    // identifies the peer in /v1/peers/{id}/events
 	Url      string // endpoint to ping
 	Host     string // hostname from Url
 	Limit    int    // number of pings before exiting
 	Delay    int    // delay between pings
 	Maxfail  int    // max failures before exiting
 	Location string // location of this peer
-	PeerIP   string // peer's IP address (used for IP override)
+	PeerIP   string // IP address override, or "" to look up Host each ping
+	Labels   Labels `json:",omitempty"` // key:value labels of the peer (region, provider ...)
+
+	Geo        *client.Geo `json:",omitempty"` // structured location, from config or the peer's pongs
+	DistanceKm float64     `json:",omitempty"` // great-circle distance from this server
+	FloorMs    float64     `json:",omitempty"` // light-in-fiber RTT over DistanceKm
+	AboveFloor float64     `json:",omitempty"` // average TCP RTT minus FloorMs, msec
 
 	FirstPing  time.Time    // first ping request
 	LatestPing time.Time    // most recent ping response
 	Pings      int          // number of successful responses
 	Fails      int          // number of ping failures seen
+	Health     string       `json:",omitempty"` // up, or down after failures in a row (see notePing)
 	PingTotals pt.PingTimes // aggregates ping time results
 
-	ms *meshSrv   // point back to the server for receivers to access state
-	mu sync.Mutex // make peer reentrant
+	DnsCached  int     `json:",omitempty"` // probe lookups answered from the resolver cache (DnsLk about 0)
+	DnsFresh   int     `json:",omitempty"` // probe lookups sent to the resolver
+	DnsFreshLk float64 `json:",omitempty"` // average DnsLk of the DnsFresh lookups, msec
+
+	OneWay  *client.OneWay    `json:",omitempty"` // one-way delay estimates (pingmesh peers only)
+	BwDelay int               `json:",omitempty"` // seconds between bandwidth probes, 0 is off
+	BwSize  int64             `json:",omitempty"` // bytes to transfer each way per probe
+	Bw      *BwStats          `json:",omitempty"` // bandwidth probe results
+	UDP     *client.UDPStats  `json:",omitempty"` // latest udp:// probe interval
+	UDPSent int               `json:",omitempty"` // udp:// packets sent, all intervals
+	UDPRecv int               `json:",omitempty"` // udp:// packets echoed, all intervals
+	DNS     *client.DNSStats  `json:",omitempty"` // latest dns:// probe response
+	DNSDiff int               `json:",omitempty"` // times the dns:// answers changed
+	GRPC    *client.GRPCStats `json:",omitempty"` // latest grpc:// call status
+	WS      *client.WSStats   `json:",omitempty"` // latest ws:// sample
+
+	Proto   string                 `json:",omitempty"` // HTTP protocol to request: h1, h2, h2c or auto
+	Protos  map[string]*ProtoStats `json:",omitempty"` // successful pings by negotiated protocol
+	Method  string                 `json:",omitempty"` // HTTP request method, GET if empty
+	Headers headerMap              `json:",omitempty"` // HTTP request headers (credentials redacted)
+	Body    string                 `json:"-"`          // HTTP request body (not shown, it may hold credentials)
+
+	FollowRedirects int                   `json:",omitempty"` // most redirects to follow, 0 to time the redirect
+	Redirect        *client.RedirectStats `json:",omitempty"` // hops of the latest followed request
+
+	Proxy  proxyURL           `json:",omitempty"` // HTTP CONNECT or SOCKS5 proxy URL (password hidden)
+	Tunnel *client.ProxyStats `json:",omitempty"` // latest connection through the proxy
+	Source string             `json:",omitempty"` // source IP or interface pings are sent from
+
+	Family    string `json:",omitempty"` // address family to connect over, ipv4 or ipv6 (either if empty)
+	Fallbacks int    `json:",omitempty"` // pings that fell back to the other family (Happy Eyeballs)
+
+	AllIPs     bool     `json:",omitempty"` // ping every address of the host, a child peer each (see FanOut)
+	Resolve    int      `json:",omitempty"` // seconds between DNS lookups for AllIPs
+	IPs        []string `json:",omitempty"` // addresses from the latest AllIPs lookup
+	FromAllIPs bool     `json:",omitempty"` // this is a child of an AllIPs peer, for PeerIP
+
+	Remote        string      `json:",omitempty"` // IP address of the latest response
+	Remotes       []*RemoteIP `json:",omitempty"` // every IP address a response came from
+	IPChangeCount int         `json:",omitempty"` // times the serving IP changed
+	IPChanges     []IPChange  `json:",omitempty"` // the latest changes of serving IP
+
+	AnomalyFactor float64    `json:",omitempty"` // TCP RTT over Baseline times this is anomalous, 0 is off
+	Baseline      Baseline   // rolling TCP RTT baseline (see checkAnomaly)
+	Anomalies     []*Anomaly `json:",omitempty"` // the latest anomaly events
+
+	Expect      *client.Expect `json:",omitempty"` // assertions about the response
+	AssertFails int            `json:",omitempty"` // failures (counted in Fails) due to assertions
+	LastAssert  string         `json:",omitempty"` // the latest assertion failure
+
+	ms       *meshSrv          // point back to the server for receivers to access state
+	mu       sync.Mutex        // make peer reentrant
+	probe    sync.Mutex        // held while probing, so Ping and Bandwidth do not overlap
+	stopped  chan struct{}     // closed when Ping returns
+	ws       *client.WSSession // connection held open for ws:// peers
+	fellBack bool              // the latest ping fell back to the other address family
+	quit     chan struct{}     // closed to stop the peer (see Stop)
+	stopOnce sync.Once
+
+	failRun      int       // ping failures in a row
+	anomalyRun   int       // samples in a row on the other side of the threshold
+	pending      []float64 // anomalous samples not yet an event
+	pendingStart time.Time // time of the first pending sample
+}
+
+////
+//  MarshalJSON encodes the peer while holding p.mu, so dumping it for
+//  /v1/peers does not race with its Ping goroutine updating it
+func (p *peer) MarshalJSON() ([]byte, error) {
+	type fields peer // the same fields, without this method
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return json.Marshal((*fields)(p))
 }
 
 ////
@@ -61,6 +140,65 @@ var (
 	PeerAlreadyPresent = errors.New("Peer already present in peers list")
 )
 
+////
+//  remoteName names the peer in failure messages: its location if known,
+//  else the IP it was pinged on (from result, if not nil), else its host
+func (p *peer) remoteName(result *pt.PingTimes) string {
+	remote := p.Location
+	if len(remote) == 0 || remote == client.LocUnknown {
+		if len(p.PeerIP) > 0 {
+			remote = p.PeerIP
+		} else if result != nil && len(result.Remote) > 0 {
+			remote = result.Remote
+		} else {
+			remote = p.Host
+		}
+	}
+	return remote
+}
+
+////
+//  giveUp marks the peer down when it hits its failure limit, for any kind
+//  of failure, and alerts only if the other vantage points agree the
+//  target is down; otherwise it logs why it is not alerting
+func (p *peer) giveUp(remote, failure string) {
+	func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.Health = HealthDown
+	}()
+	if verdict, isolated := p.ms.targetVerdict(p.Url); verdict == HealthDown {
+		client.LogSentryTags(sentry.LevelWarning, p.sentryTags(), "%s to %s: %s hit failure limit %d on %s, Ping quitting", p.srcLocation(), remote, failure, p.Fails, p.Url)
+	} else {
+		if isolated {
+			verdict += " (this node looks isolated)"
+		}
+		log.Println(p.srcLocation(), "to", remote, failure, "hit failure limit", p.Fails, "on", p.Url+", Ping quitting; not alerting, consensus is", verdict)
+	}
+}
+
+////
+//  srcLocation is the server's location, labelled with the peer's source and
+//  address family (if set) so results from different uplinks or families
+//  can be told apart
+func (p *peer) srcLocation() string {
+	return p.ms.SrvLocation() + p.pathLabel()
+}
+
+////
+//  pathLabel describes the peer's source and address family, like
+//  " via eth1 (ipv6)", or "" if neither is set
+func (p *peer) pathLabel() string {
+	var label string
+	if len(p.Source) > 0 {
+		label = " via " + p.Source
+	}
+	if len(p.Family) > 0 {
+		label += " (" + p.Family + ")"
+	}
+	return label
+}
+
 ////
 //  Info returns a string with basic peer state
 func (p *peer) Info() string {
@@ -76,8 +214,11 @@ func init() {
 //  Ping sends HTTP requests to the configured Url and captures detailed timing
 //  information. It repeats the ping request after a delay (in time.Seconds).
 func (p *peer) Ping() {
+	// tell the Bandwidth goroutine (if any) to stop, after Delete below
+	defer close(p.stopped)
 	// this task is recorded in the waitgroup, so clear waitgroup on return
 	defer p.ms.Done()
+	defer p.ws.Close() // no-op unless ws:// peer
 	// This must come after Done and before Reporter (executes in reverse order)
 	defer p.ms.Delete(p)
 
@@ -106,11 +247,10 @@ func (p *peer) Ping() {
 		}
 
 		fc := float64(p.Pings)
-		elapsed := Hhmmss_d(p.PingTotals.Start)
-
-		fmt.Printf("\nRecorded %d samples in %s, average values:\n"+"%s"+
+		elapsed := Hhmmss(p.ms.clock.Now().Unix() - p.FirstPing.Unix())
+		fmt.Printf("\nRecorded %d samples in %s%s, average values:\n"+"%s"+
 			"%d %-6s\t%.03f\t%.03f\t%.03f\t%.03f\t%.03f\t%.03f\t\t%d\t%s\t%s\n\n",
-			p.Pings, elapsed, pt.PingTimesHeader(),
+			p.Pings, elapsed, p.pathLabel(), pt.PingTimesHeader(),
 			p.Pings, elapsed,
 			pt.Msec(p.PingTotals.DnsLk)/fc,
 			pt.Msec(p.PingTotals.TcpHs)/fc,
@@ -123,7 +263,6 @@ func (p *peer) Ping() {
 			*p.PingTotals.DestUrl)
 	}()
 
-	p.FirstPing = time.Now().UTC().Truncate(time.Second)
 	for {
 		if p.ms.DoneChan() == nil {
 			// channel is nil, reading from it will block, return
@@ -144,7 +283,7 @@ func (p *peer) Ping() {
 		}
 
 		select {
-		case <-time.After(JitterPct(sleepTime, 1)):
+		case <-p.ms.clock.After(p.ms.jitterPct(sleepTime, 1)):
 			// we waited for the delay and got nothing ... loop around
 
 		case newdelay, more := <-p.ms.DoneChan():
@@ -162,10 +301,27 @@ func (p *peer) Ping() {
 			}
 			// we did not (finish) our sleep in this case ...
 		}
+		if p.stopping() {
+			// stopped by an all_ips parent (see FanOut)
+			return
+		}
 
 		////
 		// Try to fetch the URL
-		ptResult := client.FetchURL(p.Url, p.PeerIP)
+		var result *client.FetchResult
+		func() {
+			p.probe.Lock() // not during a bandwidth probe
+			defer p.probe.Unlock()
+			if p.ws != nil {
+				result = p.ws.FetchWith(p.PeerIP, p.fetchOptions())
+			} else {
+				result = client.FetchWith(p.Url, p.PeerIP, p.fetchOptions())
+			}
+		}()
+		var ptResult *pt.PingTimes
+		if result != nil {
+			ptResult = &result.PingTimes
+		}
 
 		switch {
 		// result nil, something totally failed
@@ -174,22 +330,25 @@ func (p *peer) Ping() {
 				p.mu.Lock()
 				defer p.mu.Unlock()
 				p.Fails++
+				p.notePing(false)
 			}()
-			log.Println("fetch failure", p.Fails, "of", maxfail, "on", p.Url)
 			if p.Fails >= maxfail {
+				p.giveUp(p.remoteName(nil), "fetch failure")
 				return
 			}
+			log.Println("fetch failure", p.Fails, "of", maxfail, "on", p.Url)
 			continue
 
-		// HTTP 200 OK and 300 series "OK" status codes
-		case ptResult.RespCode <= 304:
+		// HTTP 200 OK and 300 series "OK" status codes (or those the peer's
+		// assertions expect), and no assertion failed
+		case len(result.Assert) == 0 && p.Expect.StatusOK(ptResult.RespCode):
 			// Take a write lock on this peer before updating values
 			// (make each peer read/write reentrant, also []*peers)
 			func() {
 				p.mu.Lock()
 				defer p.mu.Unlock()
 				p.Pings++
-				now := time.Now().UTC()
+				now := p.ms.clock.Now().UTC()
 				p.LatestPing = now.UTC().Truncate(time.Second)
 				if p.Pings == 1 {
 					////
@@ -205,8 +364,16 @@ func (p *peer) Ping() {
 					p.PingTotals.Size += ptResult.Size
 				}
 
-				if len(p.PeerIP) == 0 && len(ptResult.Remote) > 0 {
-					p.PeerIP = ptResult.Remote
+				p.addStats(result)
+				p.addProto(result)
+				p.checkAnomaly(pt.Msec(ptResult.TcpHs))
+				p.notePing(true)
+				if result.Pong != nil {
+					p.ms.noteVantage(result.Node, *ptResult.Location, result.Verdicts)
+					if p.OneWay == nil {
+						p.OneWay = new(client.OneWay)
+					}
+					p.OneWay.Add(result.Pong)
 				}
 
 				if p.Location == client.LocUnknown {
@@ -224,29 +391,32 @@ func (p *peer) Ping() {
 				}
 			}()
 
-		// HTTP 500 series error
-		case ptResult.RespCode > 304:
+		// HTTP 400 and 500 series errors
+		// or an assertion about the response failed (see client.Expect)
+		default:
 			func() {
 				p.mu.Lock()
 				defer p.mu.Unlock()
 				p.Fails++
-			}()
-			remote := p.Location
-			if len(remote) == 0 || remote == client.LocUnknown {
-				if len(p.PeerIP) > 0 {
-					remote = p.PeerIP
-				} else {
-					remote = p.Host
+				p.addStats(result)
+				if len(result.Assert) > 0 {
+					p.AssertFails++
+					p.LastAssert = result.Assert
 				}
-			}
+				p.notePing(false)
+			}()
+			remote := p.remoteName(ptResult)
 			if p.ms.Verbose() > 0 {
 				fmt.Println(p.Pings, ptResult.MsecTsv())
 			}
+			if len(result.Assert) > 0 {
+				log.Println(p.srcLocation(), "to", remote, "assertion failed:", result.Assert, "on", p.Url)
+			}
 			if p.Fails >= maxfail {
-				client.LogSentry(sentry.LevelWarning, "%s to %s: HTTP error %d hit failure limit %d on %s, Ping quitting", p.ms.SrvLocation(), remote, ptResult.RespCode, p.Fails, p.Url)
+				p.giveUp(remote, fmt.Sprintf("HTTP error %d", ptResult.RespCode))
 				return
 			} else {
-				log.Println(p.ms.SrvLocation(), "to", remote, "HTTP", ptResult.RespCode, "failure", p.Fails, "of", maxfail, "on", p.Url)
+				log.Println(p.srcLocation(), "to", remote, "HTTP", ptResult.RespCode, "failure", p.Fails, "of", maxfail, "on", p.Url)
 			}
 			continue
 
@@ -270,7 +440,7 @@ func (p *peer) Ping() {
 
 		if p.ms.CwFlag() {
 			metric := pt.Msec(ptResult.TcpHs)
-			myLocation := p.ms.SrvLocation()
+			myLocation := p.srcLocation()
 			if p.ms.Verbose() > 2 {
 				log.Println("publishing TCP RTT", metric, "msec to CloudWatch", ns, "from", myLocation)
 			}
@@ -282,8 +452,27 @@ func (p *peer) Ping() {
 			}
 
 			////
-			// Publish my location (IP or REP_LOCATION) and their location
-			cw.PublishRespTime(myLocation, p.Location, respCode, metric, mn, ns)
+			// Publish my location (IP or REP_LOCATION) and their location,
+			// with any labels as extra dimensions
+			dims := p.metricDims()
+			if len(dims) == 0 {
+				cw.PublishRespTime(myLocation, p.Location, respCode, metric, mn, ns)
+			} else {
+				publishMetric(myLocation, p.Location, respCode, metric, unitMsec, mn, ns, dims)
+			}
+			if ws := result.WS; ws != nil && ws.NewConn {
+				publishMetric(myLocation, p.Location, respCode, pt.Msec(ws.Upgrade), unitMsec, "WebSocket Upgrade", ns, dims)
+				if ws.Reconnects > 0 {
+					publishMetric(myLocation, p.Location, respCode, 1, unitCount, "WebSocket Reconnect", ns, dims)
+				}
+			}
+			if result.Fallback {
+				publishMetric(myLocation, p.Location, respCode, 1, unitCount, "Family Fallback", ns, dims)
+			}
+			if proxy := result.Proxy; proxy != nil && proxy.Connect > 0 {
+				// TCP RTT above is to the proxy; this is its tunnel setup
+				publishMetric(myLocation, p.Location, respCode, pt.Msec(proxy.Connect), unitMsec, "Proxy Connect", ns, dims)
+			}
 			// NOTE: using network RTT estimate (TcpHs) rather than full page response time
 			// TODO: This makes the legends wrong in Cloudwatch.  Fix that.
 		}
@@ -300,6 +489,60 @@ func (p *peer) Ping() {
 	}
 }
 
+////
+//  addStats records the stats from a udp://, dns://, grpc:// or ws:// probe,
+//  if any, and the IP address that answered.  The caller must hold p.mu.
+func (p *peer) addStats(result *client.FetchResult) {
+	p.noteRemote(result.Remote)
+	switch result.Lookup {
+	case client.LookupCached:
+		p.DnsCached++
+	case client.LookupFresh:
+		p.DnsFresh++
+		p.DnsFreshLk += (pt.Msec(result.DnsLk) - p.DnsFreshLk) / float64(p.DnsFresh)
+	}
+	if stats := result.UDP; stats != nil {
+		p.UDP = stats
+		p.UDPSent += stats.Sent
+		p.UDPRecv += stats.Received
+	}
+	if stats := result.DNS; stats != nil {
+		if p.DNS != nil && !client.SameRecords(p.DNS, stats) {
+			stats.Changed = true
+			p.DNSDiff++
+			if p.ms.Verbose() > 0 {
+				log.Println("dns answers changed on", p.Url, "from", p.DNS.Records, "to", stats.Records)
+			}
+		}
+		p.DNS = stats
+	}
+	if result.GRPC != nil {
+		p.GRPC = result.GRPC
+	}
+	if result.WS != nil {
+		p.WS = result.WS
+	}
+	if result.Redirect != nil {
+		p.Redirect = result.Redirect
+	}
+	if result.Proxy != nil && len(result.Proxy.Addr) > 0 {
+		p.Tunnel = result.Proxy
+	}
+	if result.Fallback {
+		p.Fallbacks++
+	}
+	if result.Geo != nil && p.Geo == nil {
+		p.Geo = result.Geo // a configured location takes precedence
+	}
+	p.updateFloor()
+	if result.Fallback != p.fellBack && len(result.Family) > 0 {
+		p.fellBack = result.Fallback
+		if p.ms.Verbose() > 0 {
+			log.Println(p.srcLocation(), "to", p.Url, "now connects over", result.Family)
+		}
+	}
+}
+
 ////
 //  AddPeersPeers attempts to add my peer's peers to my list.
 //  The peer must be a pingmesh peer (must support /v1/peers).
@@ -334,18 +577,15 @@ func (p *peer) AddPeersPeers() {
 	for _, rmp := range rm.Peers {
 		url := rmp.Url
 		ip := rmp.PeerIP
-		peer := p.ms.FindPeer(url, ip)
-		if peer != nil {
+		labels, geo := rmp.Labels, rmp.Geo
+		setup := func(np *peer) { np.Labels, np.Geo = labels, geo }
+		if _, err := p.ms.addPingTarget(url, ip, p.Location, nil, "", setup); err == PeerAlreadyPresent {
 			if p.ms.Verbose() > 2 {
 				log.Println("peer", url, ip, "-- PeerAlreadyPresent")
 			}
 			continue
 		}
-
-		log.Println("adding peer", url, ip)
-		peer = p.ms.NewPeer(url, ip, p.Location)
-		peer.ms.Add() // for the Ping goroutine
-		go peer.Ping()
+		log.Println("added peer", url, ip)
 	}
 }
 
@@ -353,6 +593,12 @@ func (p *peer) AddPeersPeers() {
 //  JitterPct returns a millisecond time.Duration jittered by +/- pct, which
 //  should be between 1 and 100.  The returned duration will never be negative.
 func JitterPct(secs, pct int) time.Duration {
+	return jitter(secs, pct, rand.Float64())
+}
+
+////
+//  jitter computes JitterPct given a random value f in [0,1)
+func jitter(secs, pct int, f float64) time.Duration {
 	if pct < 1 {
 		pct = 1
 	} else if pct > 200 { // prevents retval from going negative
@@ -360,10 +606,9 @@ func JitterPct(secs, pct int) time.Duration {
 	}
 
 	msec := float64(secs * 1000)
-	jitter := (msec * float64(pct) / 100.0) * (rand.Float64() - 0.5)
+	jitter := (msec * float64(pct) / 100.0) * (f - 0.5)
 
 	return time.Duration(msec+jitter) * time.Millisecond
-
 }
 
 //  Hhmmss returns a representation of the number of seconds (secs) like
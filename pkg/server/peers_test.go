@@ -0,0 +1,291 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recClock records the delays the ping loop asks for
+type recClock struct {
+	*VirtualClock
+	mu     sync.Mutex
+	delays []time.Duration
+}
+
+func (c *recClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	c.delays = append(c.delays, d)
+	c.mu.Unlock()
+	return c.VirtualClock.After(d)
+}
+
+func TestPingSchedule(t *testing.T) {
+	start := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	seed := int64(7)
+
+	cases := []struct {
+		status         int // target response code
+		limit, maxfail int
+		delay          int
+		pings, fails   int // expected at exit
+	}{
+		{200, 3, 10, 5, 3, 0},
+		{200, 1, 10, 30, 1, 0},
+		{500, 0, 3, 5, 0, 3}, // unlimited pings, quits on maxfail
+		{500, 2, 5, 5, 0, 2}, // maxfail is capped by the limit
+	}
+
+	for n, c := range cases {
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(c.status)
+		}))
+
+		ms := NewMeshServer("here", 0, c.limit, c.delay, c.maxfail, 0)
+		clock := &recClock{VirtualClock: NewVirtualClock(start)}
+		ms.SetClock(clock)
+		ms.SetRandSeed(seed)
+		go ms.Simulate(clock.VirtualClock)
+
+		ms.AddPingTarget(target.URL, "", client.LocUnknown)
+		ms.Wait()
+		ms.CloseDoneChan()
+		target.Close()
+
+		if len(ms.DelPeers) != 1 {
+			t.Fatal("case", n, "want 1 deleted peer, got", len(ms.DelPeers))
+		}
+		p := ms.DelPeers[0]
+		if p.Pings != c.pings || p.Fails != c.fails {
+			t.Error("case", n, "pings", p.Pings, "fails", p.Fails, "want", c.pings, c.fails)
+		}
+
+		// the first wait (and every wait before a success) is one second,
+		// then the peer delay, each jittered by the seeded random source
+		rnd := rand.New(rand.NewSource(seed))
+		var want []time.Duration
+		var elapsed time.Duration
+		for i := 0; i < c.pings+c.fails; i++ {
+			secs := 1
+			if i > 0 && c.status == 200 {
+				secs = c.delay
+			}
+			d := jitter(secs, 1, rnd.Float64())
+			want = append(want, d)
+			elapsed += d
+		}
+		if len(clock.delays) != len(want) {
+			t.Fatal("case", n, "got delays", clock.delays, "want", want)
+		}
+		for i := range want {
+			if clock.delays[i] != want[i] {
+				t.Error("case", n, "delay", i, "got", clock.delays[i], "want", want[i])
+			}
+		}
+
+		if !p.FirstPing.Equal(start) {
+			t.Error("case", n, "FirstPing", p.FirstPing, "want", start)
+		}
+		if end := start.Add(elapsed).Truncate(time.Second); !p.LatestPing.Equal(end) {
+			t.Error("case", n, "LatestPing", p.LatestPing, "want", end)
+		}
+	}
+}
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewVirtualClock(start)
+	t3 := c.After(3 * time.Second)
+	t1 := c.After(1 * time.Second)
+	t2 := c.After(2 * time.Second)
+
+	if n := c.Advance(500 * time.Millisecond); n != 0 {
+		t.Error("fired", n, "timers early")
+	}
+	if n := c.Next(); n != 1 || !(<-t1).Equal(start.Add(time.Second)) {
+		t.Error("Next fired", n, "want the 1s timer")
+	}
+	if n := c.Advance(5 * time.Second); n != 2 {
+		t.Error("Advance fired", n, "want 2")
+	}
+	<-t2
+	if now := <-t3; !now.Equal(start.Add(6 * time.Second)) {
+		t.Error("t3 fired at", now)
+	}
+	if c.Waiting() != 0 || c.Next() != 0 {
+		t.Error("timers left over")
+	}
+}
+
+func TestAddStats(t *testing.T) {
+	p := &peer{ms: NewMeshServer("here", 0, 0, 1, 10, 0)}
+	answers := [][]string{
+		{"10.0.0.1", "10.0.0.2"},
+		{"10.0.0.1", "10.0.0.2"},
+		{"10.0.0.3"},
+		{"10.0.0.3"},
+	}
+	for i, recs := range answers {
+		p.addStats(&client.FetchResult{DNS: &client.DNSStats{Answers: len(recs), Records: recs}})
+		if changed := i == 2; p.DNS.Changed != changed {
+			t.Error("probe", i, "changed", p.DNS.Changed)
+		}
+	}
+	if p.DNSDiff != 1 {
+		t.Error("want 1 change, got", p.DNSDiff)
+	}
+
+	p.addStats(&client.FetchResult{UDP: &client.UDPStats{Sent: 10, Received: 9}})
+	p.addStats(&client.FetchResult{UDP: &client.UDPStats{Sent: 10, Received: 10}})
+	if p.UDPSent != 20 || p.UDPRecv != 19 || p.UDP.Received != 10 {
+		t.Error("udp", p.UDPSent, p.UDPRecv, p.UDP)
+	}
+}
+
+func TestNoteRemote(t *testing.T) {
+	p := &peer{Url: "http://edge.example.com/", ms: NewMeshServer("here", 0, 0, 1, 10, 0)}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.1", "", "10.0.0.2", "10.0.0.1"} {
+		var r client.FetchResult
+		r.Remote = ip
+		p.addStats(&r)
+	}
+	if p.Remote != "10.0.0.1" || p.PeerIP != "" || len(p.Remotes) != 2 || p.Remotes[0].Pings != 3 {
+		t.Error("remote", p.Remote, "peerIP", p.PeerIP, "remotes", p.Remotes)
+	}
+	if p.IPChangeCount != 2 || len(p.IPChanges) != 2 || p.IPChanges[0].From != "10.0.0.1" || p.IPChanges[0].To != "10.0.0.2" {
+		t.Error("changes", p.IPChangeCount, p.IPChanges)
+	}
+
+	// a name with many addresses keeps only the most recent
+	for i := 0; i < 2*maxRemotes; i++ {
+		var r client.FetchResult
+		r.Remote = "10.0.1." + strconv.Itoa(i)
+		p.addStats(&r)
+	}
+	if len(p.Remotes) != maxRemotes || p.Remotes[maxRemotes-1].IP != "10.0.1.99" {
+		t.Error("remotes", len(p.Remotes))
+	}
+}
+
+func TestFindPeer(t *testing.T) {
+	ms := NewMeshServer("here", 0, 0, 1, 10, 0)
+	for _, url := range []string{"http://example.com/v1/ping", "dns://10.0.0.53/example.com?type=A"} {
+		ms.Peers = append(ms.Peers, ms.NewPeer(url, "", "there"))
+	}
+	cases := []struct {
+		url   string
+		found bool
+	}{
+		{"http://example.com/other", true}, // same host
+		{"dns://10.0.0.53/example.com?type=A", true},
+		{"dns://10.0.0.53/example.com?type=AAAA", false},
+		{"dns://10.0.0.53/example.org?type=A", false},
+	}
+	for _, c := range cases {
+		if p := ms.FindPeer(c.url, ""); (p != nil) != c.found {
+			t.Error(c.url, "found", p != nil)
+		}
+	}
+}
+
+func TestAllIPs(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if host, _, _ := net.SplitHostPort(r.Host); host != "edge.example.com" {
+			t.Error("Host", r.Host)
+		}
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	ms := NewMeshServer("here", 0, 0, 5, 100, 0)
+	clock := NewVirtualClock(time.Unix(1000, 0))
+	ms.SetClock(clock)
+	var mu sync.Mutex
+	ips := []string{"127.0.0.1", "127.0.0.2"}
+	ms.lookup = func(host string) ([]net.IPAddr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if host != "edge.example.com" {
+			t.Error("lookup", host)
+		}
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+	settle := func() {
+		for i := 0; i < 5000 && clock.Waiting() != ms.Sleepers(); i++ {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	children := func() map[string]*peer {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		found := make(map[string]*peer)
+		for _, p := range ms.Peers {
+			if p.FromAllIPs {
+				found[p.PeerIP] = p
+			}
+		}
+		return found
+	}
+
+	if _, err := ms.AddPeerSpec(&PeerSpec{Url: "http://edge.example.com:" + port + "/", AllIPs: true, Resolve: 30}); err != nil {
+		t.Fatal(err)
+	}
+	settle()
+	if c := children(); len(c) != 2 || c["127.0.0.1"] == nil || c["127.0.0.2"] == nil {
+		t.Fatal("children", c)
+	}
+
+	mu.Lock()
+	ips = ips[:1]
+	mu.Unlock()
+	clock.FireAll() // pings, then the next lookup stops 127.0.0.2
+	settle()
+	clock.FireAll() // which exits when it wakes
+	settle()
+	c := children()
+	if len(c) != 1 || c["127.0.0.1"] == nil || c["127.0.0.1"].Pings == 0 {
+		t.Error("after 127.0.0.2 left DNS, children", c)
+	}
+
+	ms.CloseDoneChan()
+	clock.FireAll()
+	ms.Wait()
+	if len(ms.Peers) != 0 {
+		t.Error("peers left", ms.Peers)
+	}
+}
+
+func TestTransferContext(t *testing.T) {
+	ms := NewMeshServer("here", 0, 0, 10, 10, 0)
+	for delay, want := range map[int]time.Duration{2: 2 * time.Second, 600: bwMaxTime, 0: bwMaxTime} {
+		p := ms.NewPeer("http://example.com/v1/ping", "", "there")
+		p.Delay = delay
+		ctx, cancel := p.transferContext()
+		if dl, ok := ctx.Deadline(); !ok || time.Until(dl) > want || time.Until(dl) < want-time.Second {
+			t.Error("delay", delay, "transfer deadline in", time.Until(dl))
+		}
+		cancel()
+	}
+
+	// shutdown cuts a transfer short
+	p := ms.NewPeer("http://example.com/v1/ping", "", "there")
+	ctx, cancel := p.transferContext()
+	defer cancel()
+	ms.CloseDoneChan()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Error("transfer not canceled at shutdown")
+	}
+}
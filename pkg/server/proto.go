@@ -0,0 +1,57 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"github.com/rafayopen/perftest/pkg/pt"
+)
+
+////
+//  ProtoStats summarizes a peer's successful pings that used one HTTP
+//  protocol, so protocols can be compared.  Times are averages in msec.
+type ProtoStats struct {
+	Pings int     // number of successful responses with this protocol
+	TcpHs float64 // TCP handshake
+	TlsHs float64 // TLS handshake
+	Reply float64 // first byte
+	Total float64 // response time
+}
+
+func (ps *ProtoStats) add(r *pt.PingTimes) {
+	ps.Pings++
+	n := float64(ps.Pings)
+	ps.TcpHs += (pt.Msec(r.TcpHs) - ps.TcpHs) / n
+	ps.TlsHs += (pt.Msec(r.TlsHs) - ps.TlsHs) / n
+	ps.Reply += (pt.Msec(r.Reply) - ps.Reply) / n
+	ps.Total += (pt.Msec(r.RespTime()) - ps.Total) / n
+}
+
+////
+//  SetProto sets the default HTTP protocol for new peers: h1, h2, h2c or
+//  auto (see client.Options).  It returns false, changing nothing, if
+//  proto is not one of those.
+func (s *meshSrv) SetProto(proto string) bool {
+	if !client.ValidProto(proto) {
+		return false
+	}
+	s.proto = proto
+	return true
+}
+
+////
+//  addProto records a successful ping under the protocol it used.  The
+//  caller must hold p.mu.
+func (p *peer) addProto(result *client.FetchResult) {
+	if len(result.Proto) == 0 {
+		return // not an HTTP probe
+	}
+	if p.Protos == nil {
+		p.Protos = make(map[string]*ProtoStats)
+	}
+	ps := p.Protos[result.Proto]
+	if ps == nil {
+		ps = new(ProtoStats)
+		p.Protos[result.Proto] = ps
+	}
+	ps.add(&result.PingTimes)
+}
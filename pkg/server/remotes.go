@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"github.com/getsentry/sentry-go"
+
+	"log"
+	"time"
+)
+
+const (
+	maxIPChanges = 20 // IP changes a peer keeps in its history
+	maxRemotes   = 50 // remote IPs a peer keeps, dropping the least recent
+)
+
+////
+//  RemoteIP is an address a peer's hostname was served from
+type RemoteIP struct {
+	IP    string
+	First time.Time // first response from IP
+	Last  time.Time // latest response from IP
+	Pings int       // responses from IP, successful or not
+}
+
+////
+//  IPChange records the serving IP of a peer changing, such as a DNS
+//  failover or a CDN moving the client to another edge
+type IPChange struct {
+	At   time.Time
+	From string
+	To   string
+}
+
+////
+//  noteRemote records that the latest response came from ip, adding it to
+//  the peer's set of remote IPs, and records an IPChange if it is not the
+//  IP of the response before.  Only a change to an IP not seen before is
+//  reported to Sentry, so a round robin or anycast name does not alert on
+//  every ping.  The caller must hold p.mu.
+func (p *peer) noteRemote(ip string) {
+	if len(ip) == 0 {
+		return // proxied, or failed before connecting
+	}
+	now := p.ms.clock.Now().UTC().Truncate(time.Second)
+
+	var seen *RemoteIP
+	for _, r := range p.Remotes {
+		if r.IP == ip {
+			seen = r
+			break
+		}
+	}
+	isNew := seen == nil
+	if isNew {
+		if len(p.Remotes) >= maxRemotes {
+			p.dropRemote()
+		}
+		seen = &RemoteIP{IP: ip, First: now}
+		p.Remotes = append(p.Remotes, seen)
+	}
+	seen.Last = now
+	seen.Pings++
+
+	prev := p.Remote
+	p.Remote = ip
+	if len(prev) == 0 || prev == ip {
+		return
+	}
+
+	p.IPChangeCount++
+	p.IPChanges = append(p.IPChanges, IPChange{At: now, From: prev, To: ip})
+	if len(p.IPChanges) > maxIPChanges {
+		p.IPChanges = p.IPChanges[len(p.IPChanges)-maxIPChanges:]
+	}
+	if isNew {
+		client.LogSentryTags(sentry.LevelWarning, p.sentryTags(), "%s to %s: serving IP changed from %s to new IP %s", p.srcLocation(), p.Url, prev, ip)
+	} else if p.ms.Verbose() > 0 {
+		log.Println(p.srcLocation(), "to", p.Url+": serving IP changed from", prev, "to", ip)
+	}
+}
+
+////
+//  dropRemote removes the remote IP that responded least recently
+func (p *peer) dropRemote() {
+	oldest := 0
+	for i, r := range p.Remotes {
+		if r.Last.Before(p.Remotes[oldest].Last) {
+			oldest = i
+		}
+	}
+	p.Remotes = append(p.Remotes[:oldest], p.Remotes[oldest+1:]...)
+}
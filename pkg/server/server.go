@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	"sync"
@@ -30,34 +31,66 @@ import (
 type meshSrv struct {
 	Start time.Time // time we started the pingmesh server itself
 
-	SrvLoc     string // user-supplied location info for CW reporting
-	SrvHost    string // optional hostname
-	SrvPort    int    // server port number as reported to peers
-	listenPort int    // actual server listen port number (NOT in JSON)
+	SrvLoc     string      // user-supplied location info for CW reporting
+	SrvHost    string      // optional hostname
+	SrvPort    int         // server port number as reported to peers
+	Labels     Labels      `json:",omitempty"` // key:value labels of this server (see SetLabels)
+	Geo        *client.Geo `json:",omitempty"` // structured location, sent in pongs (see SetGeo)
+	listenPort int         // actual server listen port number (NOT in JSON)
 
 	Peers      []*peer // information about ping mesh peers (see peers.go)
 	Requests   int     // how many API requests (or pings) I have served
 	NumActive  int     // count of active peers
 	NumDeleted int     // count of deleted peers
+	numPeers   int     // peers ever added, for peer Ids
 	DelPeers   []*peer // list of last 100 deleted peers
 
 	numTests  int // from main() command line args or env vars, server default
 	pingDelay int // from main() server default ping delay
 	maxFail   int // from main() server default max failures before exiting
 
+	proto   string   // default HTTP protocol for peers (see SetProto)
+	proxy   string   // default proxy for HTTP peers (see SetProxy)
+	sources []string // ping each target from each of these (see SetSources)
+	family  string   // default address family for peers (see SetFamily)
+	anomaly float64  // default anomaly factor for peers (see SetAnomalyFactor)
+	quorum  int      // vantage points that must agree a target is down (see SetQuorum)
+	bwDelay int      // default delay between bandwidth probes (0 is off)
+	bwSize  int64    // default bandwidth probe transfer size
+	numBw   int      // count of running Bandwidth goroutines
+
 	wg      *sync.WaitGroup // ping and server threads share this wg
 	mu      sync.Mutex      // make meshSrv reentrant (protect peers)
 	done    chan int        // used to signal when threads should exit
 	cwFlag  bool            // user flag controls writing to CloudWatch
 	verbose int             // controls logging to stdout
-
-	routes []route // HTTP request to handler function mapping (plus info)
+	clock   Clock           // source of time for the ping loop (see clock.go)
+	rnd     *rand.Rand      // source of ping delay jitter (see clock.go)
+	rmu     sync.Mutex      // protect rnd
+
+	routes     []route        // HTTP request to handler function mapping (plus info)
+	routelist  string         // HTML list of routes, built on first RootHandler call
+	mux        *http.ServeMux // this server's request router
+	httpServer *http.Server   // set by startServer if listening
+	udpConn    net.PacketConn // set by StartUDPEcho if running
+
+	lookup func(host string) ([]net.IPAddr, error) // resolver for all_ips peers (tests), if not the default
+
+	vmu       sync.Mutex          // protect vantages, pongCache and pongAt
+	vantages  map[string]*vantage // other nodes' verdicts, by node ID (see Consensus)
+	pongCache map[string]string   // localVerdicts as of pongAt (see pongVerdicts)
+	pongAt    time.Time
+	node      string // this server's node ID, sent in pongs
 }
 
+////
+//  MeshServer is the exported name of a pingmesh server instance, for
+//  packages (like meshtest) that need to hold references to more than one.
+type MeshServer = meshSrv
+
 var (
-	srvServer  *meshSrv  // srvServer is a singleton
-	once       sync.Once // initialize it only once
-	httpServer *http.Server
+	srvServer *meshSrv  // srvServer is a singleton
+	once      sync.Once // initialize it only once
 )
 
 ////
@@ -70,20 +103,8 @@ func NewPingmeshServer(myLoc, hostname string, port, report int, cwFlag bool, nu
 	}
 
 	once.Do(func() {
-		ms := &meshSrv{
-			Start:      time.Now().UTC().Truncate(time.Second),
-			SrvLoc:     myLoc,
-			SrvHost:    hostname,
-			SrvPort:    report,
-			listenPort: port,
-			cwFlag:     cwFlag,
-			numTests:   numTests,
-			pingDelay:  pingDelay,
-			maxFail:    maxFail,
-			verbose:    verbose,
-			wg:         new(sync.WaitGroup), // used by server and ping peers, controls exit from main()
-			done:       make(chan int),      // signals goroutines to exit after signal caught in main()
-		}
+		ms := newMeshSrv(myLoc, hostname, report, cwFlag, numTests, pingDelay, maxFail, verbose)
+		ms.listenPort = port
 
 		////
 		// Start server if a listen port has been configured.  Must call Add
@@ -100,6 +121,44 @@ func NewPingmeshServer(myLoc, hostname string, port, report int, cwFlag bool, nu
 	return srvServer
 }
 
+////
+//  NewMeshServer creates a server instance that is not the singleton and
+//  does not listen on a port.  Its routes are set up, and the caller serves
+//  them from Handler() however it likes (e.g., from an httptest.Server).
+//  It is used to run several pingmesh servers in one process.
+func NewMeshServer(myLoc string, report, numTests, pingDelay, maxFail, verbose int) *meshSrv {
+	ms := newMeshSrv(myLoc, "", report, false, numTests, pingDelay, maxFail, verbose)
+	ms.SetupRoutes()
+	return ms
+}
+
+func newMeshSrv(myLoc, hostname string, report int, cwFlag bool, numTests, pingDelay, maxFail, verbose int) *meshSrv {
+	return &meshSrv{
+		Start:     time.Now().UTC().Truncate(time.Second),
+		SrvLoc:    myLoc,
+		SrvHost:   hostname,
+		SrvPort:   report,
+		cwFlag:    cwFlag,
+		numTests:  numTests,
+		pingDelay: pingDelay,
+		maxFail:   maxFail,
+		verbose:   verbose,
+		clock:     realClock{},
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		mux:       http.NewServeMux(),
+		wg:        new(sync.WaitGroup), // used by server and ping peers, controls exit from main()
+		done:      make(chan int),      // signals goroutines to exit after signal caught in main()
+		node:      newNodeId(),
+	}
+}
+
+////
+//  Handler returns the HTTP request router for this server, which also
+//  accepts HTTP/2 without TLS for gRPC.
+func (ms *meshSrv) Handler() http.Handler {
+	return ms.h2cHandler()
+}
+
 ////
 //  PingmeshServer returns the (already existing) singleton pointer
 func PingmeshServer() *meshSrv {
@@ -119,8 +178,8 @@ func (ms *meshSrv) startServer() error {
 
 	// The ListenAndServe call should not return.  If it does the address may be in use
 	// from an instance that just exited; if so retry a few times below.
-	httpServer = &http.Server{Addr: addr, Handler: nil}
-	err := httpServer.ListenAndServe()
+	ms.httpServer = &http.Server{Addr: addr, Handler: ms.h2cHandler()}
+	err := ms.httpServer.ListenAndServe()
 	if err == http.ErrServerClosed {
 		return nil
 	}
@@ -134,7 +193,7 @@ func (ms *meshSrv) startServer() error {
 		}
 		time.Sleep(time.Duration(tries) * time.Second)
 		// now try again ... it may take a while for a previous instance to exit
-		err = httpServer.ListenAndServe()
+		err = ms.httpServer.ListenAndServe()
 		if err == http.ErrServerClosed {
 			return nil
 		}
@@ -144,17 +203,45 @@ func (ms *meshSrv) startServer() error {
 	return err
 }
 
+////
+//  StartUDPEcho runs a responder for udp:// probes on addr (like ":8080")
+//  until Shutdown.  It returns the address bound.
+func (ms *meshSrv) StartUDPEcho(addr string) (net.Addr, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if ms.verbose > 1 {
+		log.Println("UDP echo responder listening on", conn.LocalAddr())
+	}
+
+	ms.mu.Lock()
+	ms.udpConn = conn
+	ms.mu.Unlock()
+
+	ms.Add()
+	go func() {
+		defer ms.Done()
+		client.ServeUDPEcho(conn) // returns when conn is closed
+	}()
+	return conn.LocalAddr(), nil
+}
+
 func (ms *meshSrv) Shutdown() {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
+	if ms.udpConn != nil {
+		ms.udpConn.Close() // ServeUDPEcho goroutine calls Done
+		ms.udpConn = nil
+	}
 	if ms.listenPort == 0 {
 		// not listening, nothing to do
 		return
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := httpServer.Shutdown(ctx); err != nil {
+	if err := ms.httpServer.Shutdown(ctx); err != nil {
 		client.LogSentry(sentry.LevelError, "server.Shutdown: %s", err)
 	}
 	ms.listenPort = 0
@@ -178,6 +265,9 @@ func FetchRemotePeer(rawurl, ip string) (rm *meshSrv, err error) {
 
 	host, peerAddr := client.MakePeerAddr(url.Scheme, url.Host, ip)
 	urlStr := url.Scheme + "://" + host + url.Path
+	if len(url.RawQuery) > 0 {
+		urlStr += "?" + url.RawQuery // e.g., label= selectors
+	}
 
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second,
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"strings"
+)
+
+////
+//  PeerSpec describes a ping target and its options, as read from a config
+//  file (see LoadPeers) or POSTed to /v1/peers.  Zero values take the
+//  server defaults.
+type PeerSpec struct {
+	Url      string
+	IP       string `json:",omitempty"` // overrides the DNS lookup
+	Location string `json:",omitempty"`
+	Limit    int    `json:",omitempty"`
+	Delay    int    `json:",omitempty"`
+	Fails    int    `json:",omitempty"`
+	BwDelay  int    `json:",omitempty"`
+	BwSize   int64  `json:",omitempty"`
+	Proto    string `json:",omitempty"` // h1, h2, h2c or auto
+
+	Method  string            `json:",omitempty"` // GET if empty
+	Headers map[string]string `json:",omitempty"` // "Host" overrides the Host header
+	Body    string            `json:",omitempty"`
+	Expect  *client.Expect    `json:",omitempty"` // assertions about the response
+
+	FollowRedirects int    `json:",omitempty"` // most redirects to follow, 0 (the default) follows none
+	Proxy           string `json:",omitempty"` // http:// (CONNECT) or socks5:// proxy URL, "none" for no proxy
+
+	Sources []string `json:",omitempty"` // source IPs or interfaces to ping from, one peer each
+	Family  string   `json:",omitempty"` // ipv4, ipv6 or both (a peer each); either if empty
+
+	AllIPs  bool `json:",omitempty"` // ping every address of the host, re-resolved every Resolve seconds
+	Resolve int  `json:",omitempty"`
+
+	Labels Labels      `json:",omitempty"` // key:value labels, like {"region": "us-west"}
+	Geo    *client.Geo `json:",omitempty"` // the target's location, if it does not send one
+
+	AnomalyFactor float64 `json:",omitempty"` // TCP RTT over baseline times this is anomalous; negative is off
+}
+
+////
+//  AddPeerSpec adds a ping target as described by spec
+func (ms *meshSrv) AddPeerSpec(spec *PeerSpec) (*peer, error) {
+	if len(spec.Url) == 0 {
+		return nil, errors.New("peer spec has no Url")
+	}
+	if err := spec.checkCounts(); err != nil {
+		return nil, err
+	}
+	if !client.ValidProto(spec.Proto) {
+		return nil, errors.New("peer spec has unknown Proto " + spec.Proto)
+	}
+	if err := spec.Expect.Compile(); err != nil {
+		return nil, errors.New("peer spec has bad Expect: " + err.Error())
+	}
+	if spec.Family != FamilyBoth && !client.ValidFamily(spec.Family) {
+		return nil, errors.New("peer spec has unknown Family " + spec.Family)
+	}
+	for _, source := range spec.Sources {
+		if err := client.ValidSource(source); err != nil {
+			return nil, errors.New("peer spec has bad Sources: " + err.Error())
+		}
+	}
+	if spec.BwSize != 0 {
+		if err := client.ValidTransferSize(spec.BwSize); err != nil {
+			return nil, errors.New("peer spec has bad BwSize: " + err.Error())
+		}
+	}
+	if g := spec.Geo; g != nil && (math.Abs(g.Lat) > 90 || math.Abs(g.Lon) > 180) {
+		return nil, errors.New("peer spec has Geo coordinates out of range")
+	}
+	if spec.Proxy != noProxy {
+		if err := client.ValidProxy(spec.Proxy); err != nil {
+			return nil, errors.New("peer spec has bad Proxy: " + err.Error())
+		}
+	}
+	loc := spec.Location
+	if len(loc) == 0 {
+		loc = client.LocUnknown
+	}
+	return ms.addPingTarget(spec.Url, spec.IP, loc, spec.Sources, spec.Family, func(p *peer) {
+		if spec.Limit != 0 {
+			p.Limit = spec.Limit
+		}
+		if spec.Delay != 0 {
+			p.Delay = spec.Delay
+		}
+		if spec.Fails != 0 {
+			p.Maxfail = spec.Fails
+		}
+		if spec.BwDelay != 0 {
+			p.BwDelay = spec.BwDelay
+		}
+		if spec.BwSize != 0 {
+			p.BwSize = spec.BwSize
+		}
+		if len(spec.Proto) > 0 {
+			p.Proto = spec.Proto
+		}
+		p.Method = strings.ToUpper(spec.Method)
+		p.Headers = spec.Headers
+		p.Body = spec.Body
+		p.Expect = spec.Expect
+		p.FollowRedirects = spec.FollowRedirects
+		p.AllIPs, p.Resolve = spec.AllIPs, spec.Resolve
+		p.Labels = spec.Labels
+		p.Geo = spec.Geo
+		if spec.AnomalyFactor != 0 {
+			p.AnomalyFactor = spec.AnomalyFactor
+		}
+		switch spec.Proxy {
+		case "":
+		case noProxy:
+			p.Proxy = ""
+		default:
+			p.Proxy = proxyURL(spec.Proxy)
+		}
+	})
+}
+
+////
+//  fetchOptions returns the client options for this peer's requests
+func (p *peer) fetchOptions() *client.Options {
+	return &client.Options{
+		Proto:  p.Proto,
+		Method: p.Method,
+		Header: p.Headers,
+		Body:   p.Body,
+		Expect: p.Expect,
+
+		FollowRedirects: p.FollowRedirects,
+		Proxy:           string(p.Proxy),
+		Source:          p.Source,
+		Family:          p.Family,
+	}
+}
+
+////
+//  ParsePeerSpecs decodes a JSON PeerSpec, or an array of them
+func ParsePeerSpecs(data []byte) ([]PeerSpec, error) {
+	data = bytes.TrimSpace(data)
+	var specs []PeerSpec
+	if len(data) > 0 && data[0] == '{' {
+		var spec PeerSpec
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return nil, err
+		}
+		specs = []PeerSpec{spec}
+	} else if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, err
+	}
+	for i := range specs {
+		if err := specs[i].checkCounts(); err != nil {
+			return nil, errors.New(specs[i].Url + ": " + err.Error())
+		}
+	}
+	return specs, nil
+}
+
+////
+//  checkCounts rejects negative counts and intervals; a negative Delay
+//  would have the ping loop spin
+func (spec *PeerSpec) checkCounts() error {
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"Limit", spec.Limit}, {"Delay", spec.Delay}, {"Fails", spec.Fails},
+		{"BwDelay", spec.BwDelay}, {"Resolve", spec.Resolve}, {"FollowRedirects", spec.FollowRedirects},
+	} {
+		if f.value < 0 {
+			return fmt.Errorf("peer spec has negative %s %d", f.name, f.value)
+		}
+	}
+	return nil
+}
+
+////
+//  LoadPeers adds the peers described in a JSON config file, which holds an
+//  array of PeerSpec objects.  It returns the number added; peers already
+//  present are skipped.
+func (ms *meshSrv) LoadPeers(filename string) (int, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	specs, err := ParsePeerSpecs(data)
+	if err != nil {
+		return 0, err
+	}
+	added := 0
+	for i := range specs {
+		if _, err := ms.AddPeerSpec(&specs[i]); err != nil {
+			log.Println(filename, "peer", specs[i].Url, err)
+			continue
+		}
+		added++
+	}
+	return added, nil
+}
+
+////
+//  headerMap holds request headers for a peer.  Its JSON form (in
+//  /v1/peers) hides the values of headers that carry credentials.
+type headerMap map[string]string
+
+func (h headerMap) MarshalJSON() ([]byte, error) {
+	out := make(map[string]string, len(h))
+	for name, value := range h {
+		if client.SecretHeader(name) {
+			value = "(redacted)"
+		}
+		out[name] = value
+	}
+	return json.Marshal(out)
+}
+
+////
+//  proxyURL is a peer's proxy, which may include a password.  Its JSON form
+//  hides the password.
+type proxyURL string
+
+// noProxy in a PeerSpec or addpeer request overrides the server's default proxy
+const noProxy = "none"
+
+func (u proxyURL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(client.RedactURL(string(u)))
+}
+
+////
+//  SetProxy sets the default proxy for new HTTP peers, an http:// (CONNECT)
+//  or socks5:// URL, or "" for none.  It returns an error, changing
+//  nothing, if proxy is not one of those.
+func (s *meshSrv) SetProxy(proxy string) error {
+	if err := client.ValidProxy(proxy); err != nil {
+		return err
+	}
+	s.proxy = proxy
+	return nil
+}
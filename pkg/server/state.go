@@ -33,12 +33,29 @@ func (ms *meshSrv) NewPeer(url, ip, location string) *peer {
 		Delay:    ms.pingDelay,
 		Maxfail:  ms.maxFail,
 		Location: location,
+		Proto:    ms.proto,
 		ms:       ms,
+
+		AnomalyFactor: ms.anomaly,
+		stopped:       make(chan struct{}),
+		quit:          make(chan struct{}),
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		p.Proxy = proxyURL(ms.proxy)
+	}
+	if client.IsPingmeshPeer(u.Path) {
+		p.BwDelay = ms.bwDelay
+		p.BwSize = ms.bwSize
+	}
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		p.ws = client.NewWSSession(url)
 	}
 
 	func() {
 		ms.mu.Lock()
 		defer ms.mu.Unlock()
+		ms.numPeers++
+		p.Id = ms.numPeers
 		ms.Peers = append(ms.Peers, &p)
 		ms.NumActive++
 	}()
@@ -46,23 +63,108 @@ func (ms *meshSrv) NewPeer(url, ip, location string) *peer {
 	return &p
 }
 
+////
+//  SetSources sets the source IP addresses or interface names that new
+//  peers are pinged from: each target added is pinged once from each
+//  source, as a separate peer.  None (the default) uses the routing table.
+//  It returns an error, changing nothing, if a source is not usable.
+func (s *meshSrv) SetSources(sources []string) error {
+	for _, source := range sources {
+		if err := client.ValidSource(source); err != nil {
+			return err
+		}
+	}
+	s.sources = sources
+	return nil
+}
+
+// FamilyBoth pings a target over IPv4 and IPv6, as separate peers
+const FamilyBoth = "both"
+
+////
+//  SetFamily sets the default address family for new peers: ipv4, ipv6,
+//  both (a peer for each), or "" for either (whichever connects first, as
+//  the resolver and Happy Eyeballs choose).  It returns false, changing
+//  nothing, if family is not one of those.
+func (s *meshSrv) SetFamily(family string) bool {
+	if family != FamilyBoth && !client.ValidFamily(family) {
+		return false
+	}
+	s.family = family
+	return true
+}
+
 ////
 //  AddPingTarget adds a ping target at the given url, in location loc.  It
 //  picks up numTests and pingDelay from the pingmesh server instance.
 func (ms *meshSrv) AddPingTarget(url, ip, loc string) (*peer, error) {
-	peer := ms.FindPeer(url, ip)
-	if peer != nil {
-		return peer, PeerAlreadyPresent
+	return ms.addPingTarget(url, ip, loc, nil, "", nil)
+}
+
+////
+//  addPingTarget is AddPingTarget with an optional setup function, called on
+//  the new peer before its Ping goroutine starts (to override defaults).
+//  The target is pinged from each of sources, or else the server's sources
+//  (see SetSources), and over each address family in family (or else the
+//  server's, see SetFamily) as a separate peer; it returns the first one
+//  added.
+func (ms *meshSrv) addPingTarget(url, ip, loc string, sources []string, family string, setup func(*peer)) (*peer, error) {
+	if len(sources) == 0 {
+		sources = ms.sources
+	}
+	if len(sources) == 0 {
+		sources = []string{""} // the default route
+	}
+	if len(family) == 0 {
+		family = ms.family
 	}
+	families := []string{family}
+	if family == FamilyBoth {
+		families = []string{client.FamilyIPv4, client.FamilyIPv6}
+	}
+
+	var added, present *peer
+	for _, source := range sources {
+		for _, family := range families {
+			peer := ms.findPeer(url, ip, source, family, false)
+			if peer != nil {
+				if present == nil {
+					present = peer
+				}
+				continue
+			}
 
-	// Create a new peer -- and increment the server's wait group
-	peer = ms.NewPeer(url, ip, loc)
-	ms.Add() // for the ping goroutine
-	go peer.Ping()
-	return peer, nil
+			// Create a new peer -- and increment the server's wait group
+			peer = ms.NewPeer(url, ip, loc)
+			peer.Source, peer.Family = source, family
+			if setup != nil {
+				setup(peer)
+			}
+			ms.startPeer(peer)
+			if added == nil {
+				added = peer
+			}
+		}
+	}
+	if added == nil {
+		return present, PeerAlreadyPresent
+	}
+	return added, nil
 }
 
+////
+//  FindPeer returns a peer pinging url (on ip, if set), from any source and
+//  over any address family
 func (ms *meshSrv) FindPeer(url, ip string) *peer {
+	return ms.findPeer(url, ip, "", "", true)
+}
+
+////
+//  findPeer is FindPeer, matching only peers pinging from source over
+//  family unless anyPath is set.  Peers match on the host, except dns://
+//  peers: one resolver may be asked about many names and record types, so
+//  those match on the whole URL.
+func (ms *meshSrv) findPeer(url, ip, source, family string, anyPath bool) *peer {
 	u := client.ParseURL(url)
 	if u == nil {
 		log.Println("FindPeer: cannot parse URL", url)
@@ -70,13 +172,20 @@ func (ms *meshSrv) FindPeer(url, ip string) *peer {
 	}
 
 	host := u.Host
+	sameTarget := func(p *peer) bool {
+		if u.Scheme != "dns" {
+			return p.Host == host
+		}
+		pu := client.ParseURL(p.Url)
+		return pu != nil && pu.Scheme == u.Scheme && pu.Host == u.Host && pu.Path == u.Path && pu.Query().Encode() == u.Query().Encode()
+	}
 
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
 	for _, p := range ms.Peers {
 		// It's OK to ping the same URL (host) on multiple IPs
-		if p.Host == host && (len(ip) == 0 || p.PeerIP == ip) {
+		if sameTarget(p) && (len(ip) == 0 || p.PeerIP == ip) && (anyPath || p.Source == source && p.Family == family) {
 			return p
 		}
 	}
@@ -98,10 +207,10 @@ func (ms *meshSrv) Delete(p *peer) {
 	found := 0
 
 	for _, plist := range ms.Peers {
-		if plist.Url == p.Url && (len(p.PeerIP) == 0 || plist.PeerIP == p.PeerIP) {
+		if plist.Url == p.Url && (len(p.PeerIP) == 0 || plist.PeerIP == p.PeerIP) && plist.Source == p.Source && plist.Family == p.Family && plist.FromAllIPs == p.FromAllIPs {
 			found++
 			// replace latest ping time with deletion time
-			plist.LatestPing = time.Now().UTC().Truncate(time.Second)
+			plist.LatestPing = ms.clock.Now().UTC().Truncate(time.Second)
 			delPeers = append(delPeers, plist)
 		} else {
 			newPeers = append(newPeers, plist)
@@ -155,7 +264,12 @@ func (s *meshSrv) Done() {
 	s.wg.Done()
 }
 
+////
+//  DoneChan returns the channel that is closed when the server is done, or
+//  nil once it has been closed
 func (s *meshSrv) DoneChan() chan int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.done
 }
 
@@ -163,6 +277,23 @@ func (s *meshSrv) Verbose() int {
 	return s.verbose
 }
 
+////
+//  ActivePeers returns the number of peers with a running Ping goroutine
+func (s *meshSrv) ActivePeers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.NumActive
+}
+
+////
+//  Sleepers returns the number of goroutines that wait on the clock between
+//  probes: Ping goroutines plus Bandwidth goroutines
+func (s *meshSrv) Sleepers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.NumActive + s.numBw
+}
+
 ////
 // Close the wg DoneChan and set it to nil
 func (s *meshSrv) CloseDoneChan() {
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"github.com/rafayopen/pingmesh/pkg/client"
+
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	HealthUp   = "up"
+	HealthDown = "down"
+
+	// consensus verdicts on a target, besides up and down
+	VerdictPartial = "partial" // some vantage points see it down, short of a quorum
+	VerdictLocal   = "local"   // only isolated vantage points see it down
+	VerdictUnknown = "unknown" // no vantage point has a verdict yet
+
+	downRun     = 3               // failures in a row before a peer is down
+	verdictsTTL = 5 * time.Minute // how long another node's verdicts count
+)
+
+////
+//  vantage holds the verdicts another node sent with its latest pong
+type vantage struct {
+	at       time.Time
+	location string
+	verdicts map[string]string // by verdictKey
+}
+
+////
+//  VantageVerdict summarizes one vantage point's view in /v1/verdicts
+type VantageVerdict struct {
+	Node     string // its node ID (see Pong), which tells apart nodes that share a location
+	Location string
+	At       time.Time
+	Up       int
+	Down     int
+	Isolated bool `json:",omitempty"` // it sees every target down while others see them up
+}
+
+////
+//  TargetVerdict is the consensus on one target in /v1/verdicts
+type TargetVerdict struct {
+	Url     string   // the target's verdictKey
+	Verdict string   // up, down, partial, local or unknown
+	Up      []string `json:",omitempty"` // locations of the vantage points that see it up
+	Down    []string `json:",omitempty"` // locations of the vantage points that see it down
+	Quorum  int      // down verdicts needed for down
+}
+
+////
+//  Verdicts is the /v1/verdicts response
+type Verdicts struct {
+	Vantages []*VantageVerdict
+	Targets  []*TargetVerdict
+}
+
+////
+//  newNodeId returns a random ID for this server, sent in its pongs so
+//  other nodes count it as one vantage point whatever its location
+func newNodeId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+////
+//  SetQuorum sets how many vantage points must see a target down for the
+//  consensus to be down; 0 (the default) is a majority of those reporting
+//  on it.  With fewer reporting than n, all of them must agree.
+func (s *meshSrv) SetQuorum(n int) {
+	s.quorum = n
+}
+
+////
+//  notePing updates the peer's own health verdict after a ping.  The
+//  caller must hold p.mu.
+func (p *peer) notePing(ok bool) {
+	if ok {
+		p.failRun = 0
+		p.Health = HealthUp
+		return
+	}
+	p.failRun++
+	if p.failRun >= downRun {
+		p.Health = HealthDown
+	}
+}
+
+////
+//  verdictKey names the target of url so that vantage points that spell
+//  it differently agree: the scheme and lower-cased host, without a
+//  default port or any path.  As in findPeer, a dns:// target is the whole
+//  URL, since one resolver may be asked about many names.
+func verdictKey(url string) string {
+	u := client.ParseURL(url)
+	if u == nil {
+		return url
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if scheme == "http" && port == "80" || scheme == "https" && port == "443" {
+		port = ""
+	}
+	if len(port) > 0 {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	key := scheme + "://" + host
+	if scheme == "dns" {
+		key += u.Path
+		if q := u.Query().Encode(); len(q) > 0 {
+			key += "?" + q
+		}
+	}
+	return key
+}
+
+////
+//  mergeVerdict adds health to verdicts[key]: a target pinged by several
+//  peers (sources, families or URLs) is up if any of them is
+func mergeVerdict(verdicts map[string]string, key, health string) {
+	if verdicts[key] != HealthUp {
+		verdicts[key] = health
+	}
+}
+
+////
+//  localVerdicts returns this server's health verdicts on its targets, by
+//  verdictKey.  A target pinged by several peers is up if any of them is.
+func (s *meshSrv) localVerdicts() map[string]string {
+	s.mu.Lock()
+	peers := append([]*peer(nil), s.Peers...)
+	s.mu.Unlock()
+
+	var verdicts map[string]string
+	for _, p := range peers {
+		p.mu.Lock()
+		health := p.Health
+		p.mu.Unlock()
+		if len(health) == 0 || p.AllIPs {
+			continue
+		}
+		if verdicts == nil {
+			verdicts = make(map[string]string)
+		}
+		mergeVerdict(verdicts, verdictKey(p.Url), health)
+	}
+	return verdicts
+}
+
+////
+//  pongVerdicts returns localVerdicts for a ping response, recomputed at
+//  most once per the server's ping delay (or second), so answering a ping
+//  does not lock every peer.  The map is shared: do not change it.
+func (s *meshSrv) pongVerdicts() map[string]string {
+	now := s.clock.Now()
+	maxAge := time.Duration(s.pingDelay) * time.Second
+	if maxAge < time.Second {
+		maxAge = time.Second
+	}
+	s.vmu.Lock()
+	if !s.pongAt.IsZero() && now.Sub(s.pongAt) < maxAge {
+		defer s.vmu.Unlock()
+		return s.pongCache
+	}
+	s.vmu.Unlock()
+
+	verdicts := s.localVerdicts() // not under vmu: it locks s.mu and each peer
+	s.vmu.Lock()
+	defer s.vmu.Unlock()
+	s.pongCache, s.pongAt = verdicts, now
+	return verdicts
+}
+
+////
+//  noteVantage records the verdicts a pingmesh peer sent with its pong, by
+//  its node ID (or, from a peer that sends none, its location), keyed again
+//  by verdictKey in case the peer sent them by raw URL
+func (s *meshSrv) noteVantage(node, location string, verdicts map[string]string) {
+	if len(node) == 0 {
+		node = "location:" + location
+	}
+	var keyed map[string]string
+	for url, health := range verdicts {
+		if keyed == nil {
+			keyed = make(map[string]string)
+		}
+		mergeVerdict(keyed, verdictKey(url), health)
+	}
+	verdicts = keyed
+
+	s.vmu.Lock()
+	defer s.vmu.Unlock()
+	if s.vantages == nil {
+		s.vantages = make(map[string]*vantage)
+	}
+	s.vantages[node] = &vantage{at: s.clock.Now().UTC(), location: location, verdicts: verdicts}
+}
+
+////
+//  Consensus combines this server's verdicts with the fresh ones from
+//  other nodes, one vantage point per node (see noteVantage), so nodes
+//  that share a location each count.  A target is down only if a quorum
+//  of the vantage points with a verdict on it see it down.  A vantage point that sees every one
+//  of two or more targets down while the others see them up is isolated:
+//  the problem is at the prober, and a target only it sees down is local.
+func (s *meshSrv) Consensus() *Verdicts {
+	now := s.clock.Now().UTC()
+	views := map[string]*vantage{s.node: {at: now, location: s.SrvLoc, verdicts: s.localVerdicts()}}
+	func() {
+		s.vmu.Lock()
+		defer s.vmu.Unlock()
+		for node, v := range s.vantages {
+			if now.Sub(v.at) < verdictsTTL && node != s.node {
+				views[node] = v
+			}
+		}
+	}()
+
+	var nodes []string
+	urls := make(map[string]bool)
+	for node, v := range views {
+		nodes = append(nodes, node)
+		for url := range v.verdicts {
+			urls[url] = true
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if li, lj := views[nodes[i]].location, views[nodes[j]].location; li != lj {
+			return li < lj
+		}
+		return nodes[i] < nodes[j]
+	})
+
+	// others counts the other vantage points' up and down verdicts on url
+	others := func(url, except string) (up, down int) {
+		for _, node := range nodes {
+			switch views[node].verdicts[url] {
+			case HealthUp:
+				if node != except {
+					up++
+				}
+			case HealthDown:
+				if node != except {
+					down++
+				}
+			}
+		}
+		return
+	}
+
+	result := new(Verdicts)
+	isolated := make(map[string]bool)
+	for _, node := range nodes {
+		vv := &VantageVerdict{Node: node, Location: views[node].location, At: views[node].at}
+		upElsewhere := true
+		for url, health := range views[node].verdicts {
+			if health == HealthUp {
+				vv.Up++
+			} else {
+				vv.Down++
+				if up, down := others(url, node); up <= down {
+					upElsewhere = false
+				}
+			}
+		}
+		vv.Isolated = vv.Up == 0 && vv.Down >= 2 && upElsewhere
+		isolated[node] = vv.Isolated
+		result.Vantages = append(result.Vantages, vv)
+	}
+
+	var sorted []string
+	for url := range urls {
+		sorted = append(sorted, url)
+	}
+	sort.Strings(sorted)
+	for _, url := range sorted {
+		tv := &TargetVerdict{Url: url}
+		local := true
+		for _, node := range nodes {
+			switch views[node].verdicts[url] {
+			case HealthUp:
+				tv.Up = append(tv.Up, views[node].location)
+			case HealthDown:
+				tv.Down = append(tv.Down, views[node].location)
+				local = local && isolated[node]
+			}
+		}
+		n := len(tv.Up) + len(tv.Down)
+		tv.Quorum = n/2 + 1
+		if s.quorum > 0 {
+			tv.Quorum = s.quorum
+		}
+		if tv.Quorum > n {
+			tv.Quorum = n
+		}
+		switch {
+		case n == 0:
+			tv.Verdict = VerdictUnknown
+		case len(tv.Down) == 0:
+			tv.Verdict = HealthUp
+		case local:
+			tv.Verdict = VerdictLocal
+		case len(tv.Down) >= tv.Quorum:
+			tv.Verdict = HealthDown
+		default:
+			tv.Verdict = VerdictPartial
+		}
+		result.Targets = append(result.Targets, tv)
+	}
+	return result
+}
+
+////
+//  targetVerdict returns the consensus on the target of url (matched by
+//  verdictKey), and whether this server looks isolated
+func (s *meshSrv) targetVerdict(url string) (verdict string, isolated bool) {
+	key := verdictKey(url)
+	v := s.Consensus()
+	for _, vv := range v.Vantages {
+		if vv.Node == s.node {
+			isolated = vv.Isolated
+		}
+	}
+	for _, tv := range v.Targets {
+		if tv.Url == key {
+			return tv.Verdict, isolated
+		}
+	}
+	return VerdictUnknown, isolated
+}
+
+////
+//  VerdictsHandler serves /v1/verdicts, the consensus on every target
+func (s *meshSrv) VerdictsHandler(w http.ResponseWriter, r *http.Request) {
+	s.Requests++
+
+	switch r.Method {
+	case "GET":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		w.Header().Set("Content-Type", "application/json")
+		if err := enc.Encode(s.Consensus()); err != nil {
+			http.Error(w, "Error converting verdicts to json",
+				http.StatusInternalServerError)
+		}
+
+	default:
+		reason := "Invalid request method: " + r.Method
+		http.Error(w, reason, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsensus(t *testing.T) {
+	ms := NewMeshServer("here", 0, 0, 10, 10, 0)
+	for _, url := range []string{"http://a/x", "http://B:80/"} {
+		p := ms.NewPeer(url, "", "there")
+		p.Health = HealthDown
+		ms.Peers = append(ms.Peers, p)
+	}
+	// everyone else sees a and b up, so "here" is isolated
+	ms.noteVantage("id-x", "x", map[string]string{"http://a/": HealthUp, "http://b/": HealthUp, "http://c/": HealthDown})
+	ms.noteVantage("id-y", "y", map[string]string{"http://a/": HealthUp, "http://b/": HealthUp, "http://c/": HealthUp})
+	ms.noteVantage("id-z", "z", map[string]string{"http://c/x?y=1": HealthDown, "HTTP://C:80/": HealthDown})
+	ms.noteVantage("id-w", "w", map[string]string{"http://c/": HealthDown})
+
+	want := map[string]string{"http://a": VerdictLocal, "http://b": VerdictLocal, "http://c": HealthDown}
+	v := ms.Consensus()
+	if len(v.Targets) != len(want) {
+		t.Errorf("targets %+v", v.Targets)
+	}
+	for _, tv := range v.Targets {
+		if tv.Verdict != want[tv.Url] {
+			t.Error(tv.Url, "verdict", tv.Verdict, "want", want[tv.Url])
+		}
+	}
+	if verdict, isolated := ms.targetVerdict("http://A/"); verdict != VerdictLocal || !isolated {
+		t.Error("targetVerdict", verdict, isolated)
+	}
+
+	// with a quorum of 4, three down of four reporting is only partial
+	ms.SetQuorum(4)
+	if verdict, _ := ms.targetVerdict("http://c/"); verdict != VerdictPartial {
+		t.Error("quorum 4 verdict", verdict)
+	}
+}
+
+func TestVerdictKey(t *testing.T) {
+	for url, want := range map[string]string{
+		"http://example.com/v1/ping":          "http://example.com",
+		"HTTPS://Example.COM:443/x?y=1":       "https://example.com",
+		"example.com:8080/v1/ping":            "http://example.com:8080",
+		"tcp://[::1]:22":                      "tcp://[::1]:22",
+		"http://[::1]/":                       "http://[::1]",
+		"dns://8.8.8.8/example.com?type=AAAA": "dns://8.8.8.8/example.com?type=AAAA",
+	} {
+		if key := verdictKey(url); key != want {
+			t.Error(url, "key", key, "want", want)
+		}
+	}
+	if verdictKey("dns://8.8.8.8/a.com") == verdictKey("dns://8.8.8.8/b.com") {
+		t.Error("dns targets share a key")
+	}
+}
+
+func TestPongVerdicts(t *testing.T) {
+	ms := NewMeshServer("here", 0, 0, 10, 10, 0)
+	clock := NewVirtualClock(time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC))
+	ms.SetClock(clock)
+	p := ms.NewPeer("http://a/", "", "there")
+	p.Health = HealthUp
+	ms.Peers = append(ms.Peers, p)
+	if v := ms.pongVerdicts(); v["http://a"] != HealthUp {
+		t.Fatal("verdicts", v)
+	}
+
+	// a change shows in pongs after at most one ping delay
+	p.mu.Lock()
+	p.Health = HealthDown
+	p.mu.Unlock()
+	clock.Advance(9 * time.Second)
+	if v := ms.pongVerdicts(); v["http://a"] != HealthUp {
+		t.Error("recomputed early", v)
+	}
+	clock.Advance(time.Second)
+	if v := ms.pongVerdicts(); v["http://a"] != HealthDown {
+		t.Error("not recomputed", v)
+	}
+}